@@ -0,0 +1,175 @@
+package blk
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// 属性字，写在 65532 标记之后
+//
+//	attrAccept 为 1 时表示本端可以接收其余位所示的属性，之后没有 block
+//	attrSum    单独出现在 EOB 之前，后跟 block 数据的 CRC32C uint32
+//	其他情况下描述随后的 block
+const (
+	attrFlate  = 1 << 0 // block 使用 flate 压缩
+	attrGzip   = 1 << 1 // block 使用 gzip 压缩
+	attrSum    = 1 << 2 // 校验和
+	attrSeal   = 1 << 3 // block 被加密，后跟密钥 ID 和会话 ID
+	attrAccept = 1 << 15
+
+	attrCompress = attrFlate | attrGzip
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// block 校验和错误
+type ChecksumError struct {
+	Want uint32 // 对端发送的校验和
+	Got  uint32 // 收到数据的校验和
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("blk: checksum mismatch, want %08x got %08x", e.Want, e.Got)
+}
+
+// 向对端声明本端可以接收的属性，bits 与之前声明过的属性合并。
+// 旧版本会把 65532 标记当作 chunk 的大小，所以只在 Handshake 确认对端的版本之后才写出声明，
+// 握手之前的声明由握手 block 代替。写出失败时声明保留到下一个 block 之前重试，
+// 超时之外的错误同时被锁定，之后的写入返回这个错误。
+func (p *Blk) announce(bits int32) {
+	p.accept(bits)
+	q := p.lock()
+	defer p.unlock(q)
+	p.pend = true
+	if !p.wmid {
+		p.declare()
+	}
+}
+
+// 把 bits 合并到本端可以接收的属性
+func (p *Blk) accept(bits int32) {
+	for {
+		old := atomic.LoadInt32(&p.acc)
+		if atomic.CompareAndSwapInt32(&p.acc, old, old|bits) {
+			return
+		}
+	}
+}
+
+// 写出等待的属性声明，调用者需持有 wmu
+func (p *Blk) declare() error {
+	if !p.pend || p.wraw || atomic.LoadInt32(&p.vers) == 0 {
+		return nil
+	}
+	bits := atomic.LoadInt32(&p.acc)
+	n, err := p.rawWrite([]byte{0xFF, 0xFC, byte((attrAccept | bits) >> 8), byte(bits)})
+	if n != 0 {
+		// 被截断的部分由之后的写入补全
+		p.pend = false
+	}
+	if err == nil {
+		p.eventAttr(DirWrite, uint16(attrAccept|bits))
+	}
+	return err
+}
+
+// 启用或停止 block 校验。
+// 启用时会在 Handshake 之后向对端声明本端可以校验，只有收到对端的声明后发送的 block 才带有校验和，
+// 校验和是 block 数据(压缩后)的 CRC32C，写在 EOB 之前。
+// 收到的 block 带有校验和时总是被校验，不匹配时 Read，ReadBlock 和 NextBlock
+// 返回的 Reader 在 block 结束处返回 *ChecksumError，ChecksumErrors 返回累计次数。
+// 校验的 block 中间不能插入 FOM block。
+func (p *Blk) SetChecksum(on bool) *Blk {
+	p.wmu.Lock()
+	p.sum = on
+	p.wmu.Unlock()
+	if on {
+		p.announce(attrSum)
+	}
+	return p
+}
+
+// 返回校验失败的次数
+func (p *Blk) ChecksumErrors() uint64 {
+	return atomic.LoadUint64(&p.sumErrs)
+}
+
+// 属性字之后的数据大小，这些数据与属性字一起读入缓冲
+func attrSize(a uint16) int {
+	switch {
+	case a == attrSum:
+		return 4 + 2 // 校验和及 EOB
+	case a&attrAccept == 0 && a&attrSeal != 0:
+		return 9
+	}
+	return 0
+}
+
+// 处理 next 读到的属性字
+func (p *Blk) attr() error {
+	a := p.rattr
+	if a&attrAccept != 0 {
+		atomic.StoreInt32(&p.peer, int32(a&^attrAccept))
+		return nil
+	}
+	if a == attrSum {
+		return p.checksum()
+	}
+	if a&^(attrCompress|attrSeal) != 0 || p.dec != nil || p.rseal {
+		return p.violation()
+	}
+	if a&attrSeal != 0 {
+		if err := p.unsealStart(); err != nil {
+			return err
+		}
+	}
+	if a&attrCompress != 0 {
+		return p.inflate(a & attrCompress)
+	}
+	return nil
+}
+
+// 校验 block，之后必须是 EOB，校验通过时返回 FOB
+func (p *Blk) checksum() error {
+	if err := p.fill(4); err != nil {
+		return err
+	}
+	b := p.buf[p.pos : p.pos+4]
+	want := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	p.pos += 4
+	got := p.rcrc
+	err := p.next()
+	if err != FOB {
+		if err == nil || err == errAttr || err == FOM {
+			err = p.violation()
+		}
+		return err
+	}
+	if want != got {
+		atomic.AddUint64(&p.sumErrs, 1)
+		return &ChecksumError{Want: want, Got: got}
+	}
+	return FOB
+}
+
+// 返回 block 开始时的属性标记，调用者需持有 wmu
+func (p *Blk) lead(attr uint16) []byte {
+	b := p.lbuf[:4]
+	b[0], b[1], b[2], b[3] = 0xFF, 0xFC, byte(attr>>8), byte(attr)
+	if attr&attrSeal != 0 {
+		b = append(b, p.seal.wkey.id)
+		b = append(b, p.seal.sid[:]...)
+	}
+	return b
+}
+
+// 返回写在 block 最后的数据，调用者需持有 wmu
+func (p *Blk) eob() []byte {
+	if !p.wsum {
+		return _FOB
+	}
+	c := p.wcrc
+	p.tail = [10]byte{0xFF, 0xFC, 0, attrSum, byte(c >> 24), byte(c >> 16), byte(c >> 8), byte(c), 0xFF, 0xFF}
+	return p.tail[:]
+}
@@ -0,0 +1,99 @@
+package blk
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+// 写出带有校验和的 block
+func checksummed(t *testing.T, blocks ...[]byte) []byte {
+	var w bytes.Buffer
+	p := NewBlk(nil, &w).SetChecksum(true)
+	atomic.StoreInt32(&p.peer, attrSum)
+	for _, b := range blocks {
+		if len(b) > maxChunk {
+			bw := p.NewBlockWriter()
+			bw.Write(b)
+			if err := bw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := p.WriteBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Bytes()
+}
+
+// 没有调用 SetChecksum 的 Blk 也校验收到的校验和
+func TestChecksum(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	raw := checksummed(t, []byte("hello world"), big, []byte("corrupt me"), []byte("fine"))
+	for _, on := range []bool{false, true} {
+		p := NewBlk(bytes.NewReader(raw), nil).SetChecksum(on)
+		if got := readAll(t, p); string(got) != "hello world" {
+			t.Fatalf("%q", got)
+		}
+		if got := readAll(t, p); !bytes.Equal(got, big) {
+			t.Fatal(len(got))
+		}
+		readAll(t, p)
+		readAll(t, p)
+		if p.ChecksumErrors() != 0 {
+			t.Fatal(on, p.ChecksumErrors())
+		}
+	}
+}
+
+// 校验失败时返回 *ChecksumError，之后的 block 不受影响
+func TestChecksumMismatch(t *testing.T) {
+	raw := checksummed(t, []byte("corrupt me"), []byte("fine"))
+	raw[bytes.Index(raw, []byte("corrupt"))] ^= 1
+
+	p := NewBlk(bytes.NewReader(raw), nil)
+	buf := make([]byte, 100)
+	_, err := p.ReadBlock(buf)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Fatal(err)
+	}
+	if n, err := p.ReadBlock(buf); err != nil || string(buf[:n]) != "fine" {
+		t.Fatal(n, err)
+	}
+
+	p = NewBlk(bytes.NewReader(raw), nil)
+	r, err := p.NextBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); err == nil {
+		t.Fatal("no checksum error")
+	}
+	if got := readAll(t, p); string(got) != "fine" {
+		t.Fatalf("%q", got)
+	}
+	if p.ChecksumErrors() != 1 {
+		t.Fatal(p.ChecksumErrors())
+	}
+}
+
+// 握手协商校验，同时压缩
+func TestChecksumHandshake(t *testing.T) {
+	doc := testDoc(200000)
+	a, b := tcpPair(t)
+	handshake(t, a, b, Hello{Checksum: true, Compress: CompressFlate}, Hello{Compress: CompressGzip})
+	go func() {
+		a.WriteBlock(doc)
+		bw := a.NewBlockWriter()
+		bw.Write(doc)
+		bw.Close()
+	}()
+	for i := 0; i < 2; i++ {
+		if got := readAll(t, b); !bytes.Equal(got, doc) {
+			t.Fatal(i, len(got))
+		}
+	}
+	if b.ChecksumErrors() != 0 {
+		t.Fatal(b.ChecksumErrors())
+	}
+}
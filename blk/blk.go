@@ -6,34 +6,132 @@
 //	block chunk[chunk...]
 //	chunk flag[data]
 //	flag  uint16
-//		0           Close 信号 io.EOF
+//		0           Close 信号 io.EOF，没有 Close 信号的流结束是 io.ErrUnexpectedEOF
 //		1..65530    chunk data区大小
-//		65531       保留 Blk内部使用
-//		65532       保留 Blk内部使用
+//		65531       丢弃已发送的部分 block
+//		65532       属性标记，后跟 uint16 属性字
 //		65533       后续要插入一个block
 //		65534       心跳信号
 //		65535       block 结束 EOB
 package blk
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"hash/crc32"
 	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	bufSize  = 4096  // 读缓冲大小
+	maxChunk = 65530 // chunk data 区最大值
+	maxVecs  = 128   // 每次 writev 的最大 chunk 数
+)
+
+// chunk 大小
+const (
+	ChunkAdaptive    = 0     // 根据 w 的类型选择
+	DefaultChunkSize = 16382 // 默认值
 )
 
 type Blk struct {
-	r    io.Reader
-	w    io.Writer
-	size int   //chunk 剩余要读取的大小
-	pos  int   //保存跨界数据偏移量
-	end  int   //保存跨界数据结束位置
-	rerr error //最后一次 r.read 错误
-	werr error //最后一次 w.write 错误
-	rraw bool  //读出原始流
-	wraw bool  //写入原始流
+	last    int64  //最后一次读到数据的时间 UnixNano，原子操作
+	sumErrs uint64 //校验失败次数，原子操作
+	dead    int32  //心跳超时，原子操作
+	r       io.Reader
+	w       io.Writer
+	buf     []byte        //读缓冲
+	size    int           //chunk 剩余要读取的大小
+	pos     int           //读缓冲中未处理数据偏移量
+	end     int           //读缓冲中未处理数据结束位置
+	rerr    error         //最后一次 r.read 错误
+	werr    error         //最后一次 w.write 错误
+	rraw    bool          //读出原始流
+	wraw    bool          //写入原始流
+	wmu     sync.Mutex    //保护写入及心跳设置
+	stop    chan struct{} //停止心跳
+	fair    chan struct{} //公平写入队列
+	hdrs    []byte        //chunk 头，受 wmu 保护
+	vec     net.Buffers   //受 wmu 保护
+	csz     int           //写入时 chunk 的最大大小
+	cur     *blockReader  //NextBlock 返回的当前 block
+	mix     func(io.Reader)
+
+	csend  int           //发送时使用的压缩方法
+	cmin   int           //压缩阈值
+	peer   int32         //对端声明可以接收的属性，原子操作
+	rattr  uint16        //最后读到的属性字
+	dec    *bufio.Reader //当前 block 的解压器
+	inflat *inflater
+
+	acc   int32    //本端声明过的属性，原子操作
+	vers  int32    //握手协商的协议版本，0 表示没有握手，原子操作
+	pend  bool     //属性声明等待写出，受 wmu 保护
+	sum   bool     //发送时启用校验
+	wsum  bool     //当前发送的 block 带有校验和
+	wmid  bool     //正在发送一个 block
+	wseal bool     //当前发送的 block 被加密
+	lbuf  [13]byte //block 开始时的属性标记
+	wcrc  uint32   //当前发送的 block 的校验和
+	rcrc  uint32   //当前接收的 block 的校验和
+	tail  [10]byte //校验和及 EOB
+
+	seal  *sealer //加密
+	rseal bool    //当前接收的 block 被加密
+	plain []byte  //当前 chunk 解密后未读取的数据
+
+	wclose   bool          //当前 block 结束后写 Close 信号，受 wmu 保护
+	ctimeout time.Duration //Close 等待对端 Close 信号的时间
+
+	wrest []byte      //写超时后被截断的数据，之后的写入先写出，受 wmu 保护
+	wv    net.Buffers //rawWritev 使用的副本
+	skip  error       //读超时后丢弃压缩 block 的剩余部分，之后返回 skip
+	rdl   time.Time   //SetReadDeadline 设置的截止时间
+	wdl   time.Time   //SetWriteDeadline 设置的截止时间，受 wmu 保护
+
+	st    *counters //统计
+	obs   Observer  //帧事件
+	rsize int       //当前接收的 block 的大小
+	wsize int       //当前发送的 block 的大小，受 wmu 保护
 }
 
 func NewBlk(r io.Reader, w io.Writer) *Blk {
-	return &Blk{r: r, w: w}
+	return &Blk{r: r, w: w, buf: make([]byte, bufSize), csz: DefaultChunkSize, ctimeout: DefaultCloseTimeout,
+		st: new(counters)}
+}
+
+// 设置写入时 chunk 的最大大小，超过 65530 时使用 65530。
+// 较大的 chunk 减少系统调用次数，较小的 chunk 让心跳和其他 goroutine 的写入更快得到机会。
+// ChunkAdaptive 根据 w 的类型选择:
+//
+//	unix socket，文件，内存缓冲  65530
+//	其他                         DefaultChunkSize
+//
+// 应该在开始写入前设置。
+func (p *Blk) SetChunkSize(n int) *Blk {
+	if n <= ChunkAdaptive {
+		n = adaptiveChunkSize(p.w)
+	}
+	if n > maxChunk {
+		n = maxChunk
+	}
+	p.csz = n
+	return p
+}
+
+func adaptiveChunkSize(w io.Writer) int {
+	switch w.(type) {
+	case *net.UnixConn, *os.File, *bytes.Buffer, *bufio.Writer:
+		return maxChunk
+	}
+	return DefaultChunkSize
 }
 
 var (
@@ -44,25 +142,28 @@ var (
 	_FOB       = []byte{0xFF, 0xFF}
 	_HEARTBEAT = []byte{0xFF, 0xFE}
 	_FOM       = []byte{0xFF, 0xFD}
+	_ABORT     = []byte{0xFF, 0xFB}
+	_CLOSE     = []byte{0, 0}
+)
+
+var (
+	ErrBlockAborted = errors.New("blk: block aborted")      // flag: 对端放弃了正在发送的 block，已读取的部分应丢弃
+	ErrProtocol     = errors.New("blk: protocol violation") // error: 数据流不符合协议
+	errAttr         = errors.New("flag attribute")          // flag: 内部使用
 )
 
 // 读取数据到缓冲区，直到填满缓冲区或者遇到标记或错误。
 func (p *Blk) Read(b []byte) (int, error) {
 	n := 0
-	max := len(b)
-	for {
-		if n >= max {
-			return max, nil
-		}
-		r, err := p.read(b[n:])
+	for n < len(b) {
+		m, err := p.read(b[n:])
+		n += m
 		if err != nil {
 			return n, err
 		}
 		if p.rraw {
-			return len(r), err
+			break
 		}
-		copy(b[n:], r)
-		n += len(r)
 	}
 	return n, nil
 }
@@ -73,18 +174,16 @@ func (p *Blk) Read(b []byte) (int, error) {
 // 使用其他方法将产生 ETE 错误
 // 使用完毕后要即时重置回去。
 func (p *Blk) SetRaw(r bool, w bool) *Blk {
+	p.wmu.Lock()
 	p.rraw, p.wraw = r, w
-	if r {
-		p.pos = p.end
-	}
+	p.wmu.Unlock()
 	return p
 }
 
-var b2 = []byte{'0', '0'}
-
 // 试图读取一个完整 Block
 // 此方法向缓冲区填冲数据，直到遇到 EOB 标记或者填满缓冲区。
 // 如果缓冲区足够大，FOB将被忽略。反之，会返回 ETE。
+// 对端放弃 block 时返回 ErrBlockAborted，已经读到 b 中的数据应丢弃。
 // 如果 SetRaw(true,any)，会返回 ETE。
 func (p *Blk) ReadBlock(b []byte) (int, error) {
 	if p.rraw {
@@ -97,8 +196,12 @@ func (p *Blk) ReadBlock(b []byte) (int, error) {
 	if err != nil {
 		return n, err
 	}
-	_, err = p.read(b2)
-	if err == nil {
+	if p.dec != nil {
+		if _, err = p.dec.Peek(1); err == nil {
+			return n, ETE
+		}
+		err = p.undecode(err)
+	} else if err = p.head(); err == nil {
 		return n, ETE
 	}
 	if err == FOB {
@@ -107,164 +210,529 @@ func (p *Blk) ReadBlock(b []byte) (int, error) {
 	return n, err
 }
 
-// 填满缓冲，或者读完一个 chunk 或者遇到 flag 或者 error
-func (p *Blk) read(b []byte) ([]byte, error) {
-	var (
-		err     error
-		s, h, n int
-		ish     bool
-	)
+// 读取当前 chunk 的数据到 b，遇到标记或错误时返回
+func (p *Blk) read(b []byte) (int, error) {
 	if len(b) == 0 {
-		return nil, EOE
+		return 0, EOE
 	}
-	for {
-		if p.pos == p.end {
-			p.pos = 0
-			p.end = 0
-			s = 0
-			n, err = p.readraw(b)
-			if err != nil {
-				return nil, err
-			}
-			if p.rraw {
-				return b[:n], nil
+	if p.rraw {
+		if p.pos < p.end {
+			n := copy(b, p.buf[p.pos:p.end])
+			p.pos += n
+			return n, nil
+		}
+		return p.readraw(b)
+	}
+	if err := p.head(); err != nil {
+		return 0, err
+	}
+	if p.dec != nil {
+		return p.decode(b)
+	}
+	return p.data(b)
+}
+
+// 读取当前 chunk 的数据到 b，调用者需保证 p.size 不为 0
+func (p *Blk) data(b []byte) (int, error) {
+	n := len(b)
+	if n > p.size {
+		n = p.size
+	}
+	if p.rseal {
+		n = copy(b[:n], p.plain)
+		p.plain = p.plain[n:]
+	} else if p.pos < p.end {
+		n = copy(b[:n], p.buf[p.pos:p.end])
+		p.pos += n
+	} else {
+		// 缓冲已空，直接读入 b
+		var err error
+		n, err = p.readraw(b[:n])
+		if n == 0 {
+			return 0, err
+		}
+	}
+	p.size -= n
+	// 无论本端是否启用校验都要计算，收到的校验和总是被校验
+	p.rcrc = crc32.Update(p.rcrc, castagnoli, b[:n])
+	return n, nil
+}
+
+// 与 next 相同，但是处理属性标记
+func (p *Blk) head() error {
+	if p.skip != nil {
+		if _, err := io.Copy(io.Discard, &p.inflat.cr); err != nil {
+			return err
+		}
+		err := p.skip
+		p.skip = nil
+		return err
+	}
+	for p.dec == nil {
+		err := p.next()
+		if err != errAttr {
+			return err
+		}
+		if err = p.attr(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取 flag，直到遇到有数据的 chunk 或者标记或错误
+// 属性标记和随后的数据一次读入缓冲，读取超时不会停在标记中间。
+func (p *Blk) next() error {
+	for p.size == 0 {
+		if p.rseal && p.seal.rlen != 0 {
+			if err := p.unseal(); err != nil {
+				return err
 			}
-			if n == 0 {
-				continue
+			continue
+		}
+		if err := p.fill(2); err != nil {
+			return err
+		}
+		flag := int(p.buf[p.pos])<<8 | int(p.buf[p.pos+1])
+		if flag == 65532 {
+			if err := p.fill(4); err != nil {
+				return err
 			}
-			p.end = n
-		} else {
-			s = p.pos
-			n = p.end
-		}
-		if p.size == 0 {
-			if ish {
-				ish = false
-				p.size = h + int(b[s])
-				s++
-				h = 0
-			} else if n-s == 1 {
-				ish = true
-				h = int(b[s]) << 8
-				p.pos = 0
-				p.end = 0
-				continue
-			} else {
-				p.size = int(b[s])<<8 + int(b[s+1])
-				s += 2
+			if err := p.fill(4 + attrSize(uint16(p.buf[p.pos+2])<<8|uint16(p.buf[p.pos+3]))); err != nil {
+				return err
 			}
-			p.pos = s
-			switch p.size {
-			case 0:
-				return nil, io.EOF
-			case 65535:
-				return nil, FOB
-			case 65534:
-				_, err = p.HeartBeat()
-				if err != nil {
-					return nil, err
-				}
-				continue
-			case 65533:
-				return nil, FOM
+		}
+		p.pos += 2
+		switch flag {
+		case 0:
+			// 之后的读取都返回 io.EOF
+			p.rerr = io.EOF
+			p.pos, p.end = 0, 0
+			p.event(EventClose, DirRead, 0)
+			return io.EOF
+		case 65535:
+			p.rcrc = 0
+			atomic.AddUint64(&p.st.blocksIn, 1)
+			observe(&p.st.sizesIn, p.rsize)
+			p.event(EventEOB, DirRead, p.rsize)
+			p.rsize = 0
+			if p.seal != nil {
+				return p.unsealEnd()
 			}
+			return FOB
+		case 65534:
+			atomic.AddUint64(&p.st.beatsIn, 1)
+			p.event(EventHeartBeat, DirRead, 0)
+			continue
+		case 65533:
+			atomic.AddUint64(&p.st.fomIn, 1)
+			p.event(EventFOM, DirRead, 0)
+			return FOM
+		case 65531:
+			p.rcrc = 0
+			p.rseal = false
+			atomic.AddUint64(&p.st.abortsIn, 1)
+			p.event(EventAbort, DirRead, p.rsize)
+			p.rsize = 0
+			return ErrBlockAborted
+		case 65532:
+			p.rattr = uint16(p.buf[p.pos])<<8 | uint16(p.buf[p.pos+1])
+			p.pos += 2
+			p.eventAttr(DirRead, p.rattr)
+			return errAttr
 		}
-		// 只是读取到 p.size
-		if n == s {
+		atomic.AddUint64(&p.st.chunksIn, 1)
+		p.rsize += flag
+		p.event(EventChunk, DirRead, flag)
+		if p.rseal {
+			p.seal.rlen, p.seal.rn = flag, 0
 			continue
 		}
-		// 已经读入的数据是否有多个 chunk 交叉
-		if p.size < n-s {
-			p.pos = s + p.size
-			n = p.pos
-			p.size = 0
-		} else {
-			// 一个chunk可能还没有读完
-			p.size -= n - s
-			p.pos = 0
-			p.end = 0
+		if p.seal != nil {
+			return p.sealFail(ErrSealed)
+		}
+		p.size = flag
+	}
+	return nil
+}
+
+// 保证读缓冲中至少有 n 字节未处理数据
+func (p *Blk) fill(n int) error {
+	if p.end-p.pos >= n {
+		return nil
+	}
+	if p.pos != 0 {
+		p.end = copy(p.buf, p.buf[p.pos:p.end])
+		p.pos = 0
+	}
+	for p.end < n {
+		m, err := p.readraw(p.buf[p.end:])
+		p.end += m
+		if err != nil && p.end < n {
+			return err
 		}
-		return b[s:n], nil
 	}
+	return nil
+}
+
+// 设置写入是否公平排队。
+// Blk 的写入方法可以被多个 goroutine 同时调用，每次调用写入的数据在线路上是连续的。
+// 默认使用 sync.Mutex 串行化，fair 为 true 时各 goroutine 严格按调用顺序写入。
+// 必须在任何写入之前调用，包括 Handshake 和 KeepAlive 的心跳，不能与写入方法同时调用。
+func (p *Blk) SetFair(fair bool) *Blk {
+	if fair {
+		p.fair = make(chan struct{}, 1)
+	} else {
+		p.fair = nil
+	}
+	return p
 }
 
 // 写数据
+// 多次 Write 组成的 block 不是原子的，多个 goroutine 共享 Blk 时应使用 WriteBlock。
 func (p *Blk) Write(b []byte) (int, error) {
-	return p.write(b, nil)
+	return p.write(0, b, false)
 }
 
 // 写数据并添加EOB
 // 如果 SetRaw(any,true)，会返回 ETE。
+// 如果启用了压缩，超过阈值的 block 会被压缩。
 func (p *Blk) WriteBlock(b []byte) (int, error) {
-	return p.write(b, _FOB)
+	return p.writeBlock(context.Background(), b)
 }
 
-// 从缓冲 b 写数据
-func (p *Blk) write(b []byte, raw []byte) (int, error) {
-	var (
-		s, e, cnt, size, n int
-		err                error
-	)
+func (p *Blk) writeBlock(ctx context.Context, b []byte) (int, error) {
+	if d := p.deflate(b); d != nil {
+		defer d.free()
+		if _, err := p.writeContext(ctx, d.attr, d.buf.Bytes(), true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return p.writeContext(ctx, 0, b, true)
+}
+
+func (p *Blk) write(attr uint16, b []byte, eob bool) (int, error) {
+	return p.writeContext(context.Background(), attr, b, eob)
+}
+
+// 持有写锁调用 writeLocked，ctx 结束时中断写入
+func (p *Blk) writeContext(ctx context.Context, attr uint16, b []byte, eob bool) (int, error) {
+	q, err := p.lockContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer p.unlock(q)
 	if p.wraw {
-		return p.writeraw(b)
+		if err := p.flushRest(); err != nil {
+			return 0, err
+		}
+		n, err := p.w.Write(b)
+		atomic.AddUint64(&p.st.bytesOut, uint64(n))
+		return n, p.werror(err)
+	}
+	if d, ok := p.w.(writeDeadliner); ok && ctx.Done() != nil {
+		stop := watch(ctx, d.SetWriteDeadline, p.wdl)
+		n, err := p.writeLocked(attr, b, eob)
+		stop()
+		return n, ctxErr(ctx, err)
+	}
+	return p.writeLocked(attr, b, eob)
+}
+
+// 从缓冲 b 写数据，不会修改 b，调用者需持有写锁。
+// attr 是 block 开始时写在数据之前的属性字，eob 为 true 时最后写 EOB。
+// chunk 头和数据通过 net.Buffers 一起写出，w 是 TCP 或 unix 连接时使用 writev，否则合并到连续的缓冲中写出。
+// 超时时如果没有写出任何数据就恢复到写之前的状态，否则补全被截断的 chunk 后放弃 block。
+func (p *Blk) writeLocked(attr uint16, b []byte, eob bool) (int, error) {
+	mid, crc := p.wmid, p.wcrc
+	var pre []byte
+	if !p.wmid {
+		if err := p.declare(); err != nil {
+			return 0, err
+		}
+		// block 开始时决定是否校验和加密
+		p.wseal = p.seal != nil
+		if p.wseal {
+			if !p.seal.start() {
+				atomic.AddUint64(&p.st.sealErrs, 1)
+				return 0, ErrSealKey
+			}
+			attr |= attrSeal
+		}
+		p.wmid = true
+		p.wsize = 0
+		p.wsum = p.sum && atomic.LoadInt32(&p.peer)&attrSum != 0
+		if attr != 0 {
+			pre = p.lead(attr)
+		}
+	}
+	if p.wsum {
+		p.wcrc = crc32.Update(p.wcrc, castagnoli, b)
 	}
-	max := len(b)
+	if p.wseal {
+		return p.writeSealed(pre, b, eob)
+	}
+	if p.hdrs == nil {
+		p.hdrs = make([]byte, 2*maxVecs)
+		p.vec = make(net.Buffers, 0, 2*maxVecs+2)
+	}
+	cnt := 0
 	for {
-		if s >= max {
-			break
+		vec := p.vec[:0]
+		start := cnt
+		if len(pre) != 0 && start == 0 {
+			vec = append(vec, pre)
 		}
-		e = s + 16382
-		if e > max {
-			e = max
-		}
-		size = e - s
-		if s == 0 {
-			tmp := make([]byte, size+2)
-			tmp[0] = byte(size >> 8)
-			tmp[1] = byte(size)
-			copy(tmp[2:], b[s:e])
-			n, err = p.writeraw(tmp)
-			if err != nil {
-				break
+		k := 0
+		for ; k < maxVecs && cnt < len(b); k++ {
+			size := len(b) - cnt
+			if size > p.csz {
+				size = p.csz
 			}
-			n -= 2
-		} else {
-			b1, b2 := b[s-2], b[s-1]
-			b[s-2] = byte(size >> 8)
-			b[s-1] = byte(size)
-			n, err = p.writeraw(b[s-2 : e])
-			if err == nil {
-				b[s-2], b[s-1] = b1, b2
+			h := p.hdrs[2*k : 2*k+2]
+			h[0] = byte(size >> 8)
+			h[1] = byte(size)
+			vec = append(vec, h, b[cnt:cnt+size])
+			cnt += size
+		}
+		last := cnt == len(b)
+		if last && eob {
+			vec = append(vec, p.eob())
+			p.wmid, p.wcrc = false, 0
+		}
+		if len(vec) == 0 {
+			return cnt, nil
+		}
+		n, err := p.rawWritev(vec)
+		if err == ErrTimeout {
+			if start == 0 && n == 0 {
+				p.wmid, p.wcrc = mid, crc
+				return 0, err
 			}
+			hdr := 0
+			if start == 0 && len(pre) != 0 {
+				hdr = 1
+			}
+			if p.cut(vec, n, hdr, last && eob) {
+				return cnt, err
+			}
+			return 0, err
 		}
 		if err != nil {
-			break
+			if start == 0 {
+				n -= len(pre)
+			}
+			return start + p.payload(n, b[start:cnt]), err
+		}
+		atomic.AddUint64(&p.st.chunksOut, uint64(k))
+		p.wsize += cnt - start
+		if p.obs != nil {
+			p.written(vec, start == 0 && len(pre) != 0, last && eob)
+		}
+		if last {
+			if eob {
+				atomic.AddUint64(&p.st.blocksOut, 1)
+				observe(&p.st.sizesOut, p.wsize)
+				p.event(EventEOB, DirWrite, p.wsize)
+			}
+			if eob && p.wclose {
+				err = p.shut()
+			}
+			return cnt, err
 		}
-		cnt += n
-		s += n
 	}
-	if err == nil && len(raw) != 0 {
-		_, err = p.writeraw(raw)
+}
+
+// 计算写出 n 字节时其中 b 的数据量
+func (p *Blk) payload(n int, b []byte) int {
+	cnt := 0
+	for n > 2 && cnt < len(b) {
+		n -= 2
+		size := len(b) - cnt
+		if size > p.csz {
+			size = p.csz
+		}
+		if size > n {
+			size = n
+		}
+		cnt += size
+		n -= size
 	}
-	return cnt, err
+	return cnt
 }
 
 func (p *Blk) readraw(b []byte) (int, error) {
-	var n int
 	if p.rerr != nil {
 		return 0, p.rerr
 	}
-	n, p.rerr = p.r.Read(b)
-	return n, p.rerr
+	n, err := p.r.Read(b)
+	if n != 0 {
+		atomic.StoreInt64(&p.last, time.Now().UnixNano())
+		atomic.AddUint64(&p.st.bytesIn, uint64(n))
+	}
+	if err != nil && atomic.LoadInt32(&p.dead) != 0 {
+		err = ErrDead
+	} else if isTimeout(err) {
+		// 超时不影响之后的读取
+		atomic.AddUint64(&p.st.timeouts, 1)
+		return n, ErrTimeout
+	} else if err == io.EOF && !p.rraw {
+		// 没有收到 Close 信号，连接被截断
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		atomic.AddUint64(&p.st.readErrs, 1)
+		p.eventErr(DirRead, err)
+	}
+	p.rerr = err
+	return n, err
 }
 
 func (p *Blk) writeraw(b []byte) (int, error) {
-	var n int
+	q := p.lock()
+	defer p.unlock(q)
+	return p.rawWrite(b)
+}
+
+// 获得写锁，公平模式下按请求顺序排队
+func (p *Blk) lock() chan struct{} {
+	q := p.fair
+	if q != nil {
+		q <- struct{}{}
+	}
+	p.wmu.Lock()
+	return q
+}
+
+// 与 lock 相同，ctx 结束时放弃等待并返回 ctx.Err()
+func (p *Blk) lockContext(ctx context.Context) (chan struct{}, error) {
+	if ctx.Done() == nil {
+		return p.lock(), nil
+	}
+	if p.fair == nil && p.wmu.TryLock() {
+		return nil, nil
+	}
+	got := make(chan chan struct{}, 1)
+	go func() { got <- p.lock() }()
+	select {
+	case q := <-got:
+		return q, nil
+	case <-ctx.Done():
+		// 之后取得的锁立即释放
+		go func() { p.unlock(<-got) }()
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Blk) unlock(q chan struct{}) {
+	p.wmu.Unlock()
+	if q != nil {
+		<-q
+	}
+}
+
+// 写出 b，超时时保存 b 被截断的部分，之后的写入先写出。调用者需持有 wmu
+func (p *Blk) rawWrite(b []byte) (int, error) {
+	if err := p.flushRest(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	atomic.AddUint64(&p.st.bytesOut, uint64(n))
+	err = p.werror(err)
+	if err == ErrTimeout && n != 0 && n < len(b) {
+		p.wrest = append([]byte(nil), b[n:]...)
+	}
+	return n, err
+}
+
+// 调用者需持有 wmu
+func (p *Blk) rawWritev(v net.Buffers) (int, error) {
+	if err := p.flushRest(); err != nil {
+		return 0, err
+	}
+	if !writev(p.w) {
+		n, err := p.writeJoined(v)
+		return n, p.werror(err)
+	}
+	// WriteTo 会修改 v，使用副本以便超时时计算被截断的部分
+	p.wv = append(p.wv[:0], v...)
+	n, err := p.wv.WriteTo(p.w)
+	atomic.AddUint64(&p.st.bytesOut, uint64(n))
+	return int(n), p.werror(err)
+}
+
+// net.Buffers 只对这些连接使用 writev，其他的 w 每个 buffer 都要写一次
+func writev(w io.Writer) bool {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn, *net.IPConn:
+		return true
+	}
+	return false
+}
+
+// 合并写出时的缓冲大小，至少能容纳两个最大的 chunk
+const joinSize = 1 << 17
+
+var joinBufs = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, joinSize)
+	return &b
+}}
+
+// 把 v 合并到连续的缓冲中写出，超过缓冲大小时分多次写出。调用者需持有 wmu
+func (p *Blk) writeJoined(v net.Buffers) (int, error) {
+	bp := joinBufs.Get().(*[]byte)
+	defer joinBufs.Put(bp)
+	b, n := (*bp)[:0], 0
+	for i, x := range v {
+		b = append(b, x...)
+		if i+1 < len(v) && len(b)+len(v[i+1]) <= joinSize {
+			continue
+		}
+		m, err := p.w.Write(b)
+		atomic.AddUint64(&p.st.bytesOut, uint64(m))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[:0]
+	}
+	return n, nil
+}
+
+// 检查写入状态，写出超时后被截断的数据，调用者需持有 wmu
+func (p *Blk) flushRest() error {
+	if atomic.LoadInt32(&p.dead) != 0 {
+		return ErrDead
+	}
 	if p.werr != nil {
-		return 0, p.werr
+		return p.werr
+	}
+	for len(p.wrest) != 0 {
+		n, err := p.w.Write(p.wrest)
+		atomic.AddUint64(&p.st.bytesOut, uint64(n))
+		p.wrest = p.wrest[n:]
+		if err != nil {
+			return p.werror(err)
+		}
+	}
+	p.wrest = nil
+	return nil
+}
+
+// 超时之外的写错误之后不能再写入，调用者需持有 wmu
+func (p *Blk) werror(err error) error {
+	if err == nil {
+		return nil
 	}
-	n, p.werr = p.w.Write(b)
-	return n, p.werr
+	if isTimeout(err) {
+		atomic.AddUint64(&p.st.timeouts, 1)
+		return ErrTimeout
+	}
+	atomic.AddUint64(&p.st.writeErrs, 1)
+	p.werr = err
+	p.eventErr(DirWrite, err)
+	return err
 }
 
 // 写心跳信号
@@ -272,7 +740,12 @@ func (p *Blk) HeartBeat() (int, error) {
 	if p.wraw {
 		return 0, ETE
 	}
-	return p.writeraw(_HEARTBEAT)
+	n, err := p.writeraw(_HEARTBEAT)
+	if err == nil {
+		atomic.AddUint64(&p.st.beatsOut, 1)
+		p.event(EventHeartBeat, DirWrite, 0)
+	}
+	return n, err
 }
 
 // 写 Block 结束标记
@@ -280,7 +753,36 @@ func (p *Blk) FOB() (int, error) {
 	if p.wraw {
 		return 0, ETE
 	}
-	return p.writeraw(_FOB)
+	return p.write(0, nil, true)
+}
+
+// 放弃正在用 Write 发送的 block，对端丢弃已收到的部分，读取时得到 ErrBlockAborted。
+// 没有正在发送的 block 时什么也不做。如果 SetRaw(any,true)，会返回 ETE。
+func (p *Blk) AbortBlock() error {
+	if p.wraw {
+		return ETE
+	}
+	_, err := p.abort()
+	return err
+}
+
+// 写放弃 block 标记，没有正在发送的 block 时不写
+func (p *Blk) abort() (int, error) {
+	q := p.lock()
+	defer p.unlock(q)
+	if !p.wmid {
+		return 0, nil
+	}
+	p.wmid, p.wcrc = false, 0
+	n, err := p.rawWrite(_ABORT)
+	if err == nil {
+		atomic.AddUint64(&p.st.abortsOut, 1)
+		p.event(EventAbort, DirWrite, p.wsize)
+	}
+	if err == nil && p.wclose {
+		err = p.shut()
+	}
+	return n, err
 }
 
 // 写混入 Block 标记
@@ -288,5 +790,10 @@ func (p *Blk) FOM() (int, error) {
 	if p.wraw {
 		return 0, ETE
 	}
-	return p.writeraw(_FOM)
+	n, err := p.writeraw(_FOM)
+	if err == nil {
+		atomic.AddUint64(&p.st.fomOut, 1)
+		p.event(EventFOM, DirWrite, 0)
+	}
+	return n, err
 }
@@ -0,0 +1,253 @@
+package blk
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 返回一对通过 TCP 连接的 Blk，测试结束时关闭连接
+func tcpPair(t testing.TB) (a, b *Blk) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return NewBlk(c1, c1), NewBlk(c2, c2)
+}
+
+// 两端同时握手
+func handshake(t testing.TB, a, b *Blk, ha, hb Hello) (Hello, Hello) {
+	var err error
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		hb, err = b.Handshake(hb)
+		done <- err
+	}()
+	if ha, err = a.Handshake(ha); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return ha, hb
+}
+
+// 读取一个完整的 block
+func readAll(t testing.TB, p *Blk) []byte {
+	r, err := p.NextBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 记录 Write 的次数
+type countWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n++
+	return w.Buffer.Write(b)
+}
+
+func TestWriteBlockJoined(t *testing.T) {
+	w := &countWriter{}
+	p := NewBlk(nil, w)
+	d := bytes.Repeat([]byte("0123456789"), 30000)
+	if _, err := p.WriteBlock(d[:100000]); err != nil {
+		t.Fatal(err)
+	}
+	if w.n != 1 {
+		t.Fatalf("%d writes for 100000 bytes", w.n)
+	}
+	if _, err := p.WriteBlock(d); err != nil {
+		t.Fatal(err)
+	}
+	if w.n != 4 {
+		t.Fatalf("%d writes for 300000 bytes", w.n-1)
+	}
+	q := NewBlk(&w.Buffer, nil)
+	for _, want := range [][]byte{d[:100000], d} {
+		r, err := q.NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatal(len(got), err)
+		}
+	}
+}
+
+// 在 network 的连接上写 1MB 的 block，对端读取并丢弃
+func benchWriteBlock(b *testing.B, network string, csz int) {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(b.TempDir(), "blk.sock")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		b.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		q := NewBlk(c, c)
+		for {
+			r, err := q.NextBlock()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, r)
+		}
+	}()
+	c, err := net.Dial(network, l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	p := NewBlk(c, c).SetChunkSize(csz)
+	d := make([]byte, 1<<20)
+	b.SetBytes(int64(len(d)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.WriteBlock(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBlock(b *testing.B) {
+	sizes := []struct {
+		name string
+		csz  int
+	}{
+		{"default", DefaultChunkSize},
+		{"max", maxChunk},
+		{"adaptive", ChunkAdaptive},
+	}
+	for _, network := range []string{"tcp", "unix"} {
+		for _, s := range sizes {
+			network, s := network, s
+			b.Run(network+"/"+s.name, func(b *testing.B) {
+				benchWriteBlock(b, network, s.csz)
+			})
+		}
+	}
+}
+
+func TestAbortBlock(t *testing.T) {
+	for _, seal := range []bool{false, true} {
+		w, r := tcpPair(t)
+		if seal {
+			w.AddSealKey(1, sealKey1)
+			r.AddSealKey(1, sealKey1)
+		}
+		go func() {
+			if err := w.AbortBlock(); err != nil {
+				t.Error(err)
+			}
+			w.SetChunkSize(100)
+			w.Write(bytes.Repeat([]byte("x"), 500))
+			w.AbortBlock()
+			w.AbortBlock()
+			w.WriteBlock([]byte("next"))
+			w.Write([]byte("half"))
+			w.AbortBlock()
+			w.WriteBlock([]byte("last"))
+		}()
+		buf := make([]byte, 1000)
+		if n, err := r.ReadBlock(buf); err != ErrBlockAborted {
+			t.Fatal(seal, n, err)
+		}
+		n, err := r.ReadBlock(buf)
+		if err != nil || string(buf[:n]) != "next" {
+			t.Fatal(seal, n, err)
+		}
+		// 已经读到的部分有效，之后读到 ErrBlockAborted
+		br, err := r.NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ = br.Read(buf); string(buf[:n]) != "half" {
+			t.Fatal(seal, string(buf[:n]))
+		}
+		if _, err = br.Read(buf); err != ErrBlockAborted {
+			t.Fatal(seal, err)
+		}
+		n, err = r.ReadBlock(buf)
+		if err != nil || string(buf[:n]) != "last" {
+			t.Fatal(seal, n, err)
+		}
+	}
+}
+
+// 多个 goroutine 同时写入，每个 block 完整，公平模式下按调用顺序写出
+func TestConcurrentWrite(t *testing.T) {
+	const G, N = 8, 50
+	for _, fair := range []bool{false, true} {
+		w, r := tcpPair(t)
+		w.SetFair(fair)
+		// 持有写锁，依次启动的 goroutine 排队等待
+		q := w.lock()
+		for g := 0; g < G; g++ {
+			go func(g int) {
+				for i := 0; i < N; i++ {
+					w.WriteBlock(bytes.Repeat([]byte{byte(g)}, 40000+g))
+				}
+			}(g)
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.unlock(q)
+		count := make([]int, G)
+		for i := 0; i < G*N; i++ {
+			b := readAll(t, r)
+			g := int(b[0])
+			if g >= G || len(b) != 40000+g || !bytes.Equal(b, bytes.Repeat(b[:1], len(b))) {
+				t.Fatal(fair, i, g, len(b))
+			}
+			// 排队等待的第一次写入按调用顺序写出
+			if fair && i < G && g != i {
+				t.Fatal("order", i, g)
+			}
+			count[g]++
+		}
+		for g, n := range count {
+			if n != N {
+				t.Fatal(fair, g, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package blk
+
+import (
+	"io"
+)
+
+// 返回下一个 block 的 Reader，读完 block 数据后返回 io.EOF。
+// block 的大小不受限制，适合直接交给文件或解码器。
+// 调用 NextBlock 会丢弃上一个 block 未读取的数据，上一个 block 的 *ChecksumError 不会再次返回。
+// 心跳信号被自动忽略，FOM 之后插入的 block 交给 OnMixin 设置的函数处理。
+// 对端关闭时返回 io.EOF，如果 SetRaw(true,any)，会返回 ETE。
+func (p *Blk) NextBlock() (io.Reader, error) {
+	if p.rraw {
+		return nil, ETE
+	}
+	if p.cur != nil {
+		_, err := io.Copy(io.Discard, p.cur)
+		p.cur = nil
+		if _, ok := err.(*ChecksumError); ok {
+			// 校验失败的 block 已经读完，不影响之后的 block
+			err = nil
+		}
+		if err != nil && err != ErrBlockAborted {
+			return nil, err
+		}
+	}
+	for {
+		err := p.head()
+		if err == FOM {
+			err = p.mixin()
+			if err == nil {
+				continue
+			}
+		}
+		if err == ErrBlockAborted {
+			// 已经读取过一部分的 block 被放弃
+			continue
+		}
+		if err == FOB {
+			return &blockReader{p: p, done: true}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	p.cur = &blockReader{p: p}
+	return p.cur, nil
+}
+
+// 设置 FOM 之后插入的 block 的处理函数。
+// fn 返回后 r 中未读取的数据被丢弃，fn 为 nil 时插入的 block 全部被丢弃。
+// FOM 可以出现在 block 之间，也可以出现在 NextBlock 返回的 block 中间。
+func (p *Blk) OnMixin(fn func(r io.Reader)) *Blk {
+	p.mix = fn
+	return p
+}
+
+// 读取 FOM 之后插入的 block
+func (p *Blk) mixin() error {
+	crc, size := p.rcrc, p.rsize
+	defer func() { p.rcrc, p.rsize = crc, size }()
+	p.rcrc, p.rsize = 0, 0
+	r := &blockReader{p: p}
+	if p.mix != nil {
+		p.mix(r)
+	}
+	_, err := io.Copy(io.Discard, r)
+	if err == ErrBlockAborted {
+		err = nil
+	}
+	return err
+}
+
+// 一个 block 的 Reader
+type blockReader struct {
+	p    *Blk
+	done bool
+	err  error
+}
+
+func (r *blockReader) Read(b []byte) (int, error) {
+	for !r.done {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		n, err := r.p.read(b)
+		switch err {
+		case nil:
+			return n, nil
+		case FOB:
+			r.done = true
+		case FOM:
+			if err = r.p.mixin(); err != nil {
+				r.done, r.err = true, err
+			}
+		case ErrBlockAborted:
+			r.done, r.err = true, err
+		case io.EOF:
+			// block 中间不应该出现 Close 信号
+			r.done, r.err = true, io.ErrUnexpectedEOF
+		default:
+			r.done, r.err = true, err
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// 按 block 写入的 Writer，由 NewBlockWriter 创建。
+// 写入的数据先被缓冲，缓冲满 65530 字节时才写出，Close 时写出剩余数据和 EOB。
+// 启用压缩时，超过 65530 字节的 block 被流式压缩，较小的 block 与 WriteBlock 相同。
+// 与 Write 一样，由多次写入组成的 block 不是原子的，写入期间不要有其他 goroutine 写同一个 Blk。
+type BlockWriter struct {
+	p       *Blk
+	buf     []byte
+	started bool //已经有数据写出
+	closed  bool
+	z       *streamDeflater
+}
+
+// 创建写一个 block 的 BlockWriter
+func (p *Blk) NewBlockWriter() *BlockWriter {
+	return &BlockWriter{p: p}
+}
+
+func (w *BlockWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.p.wraw {
+		return 0, ETE
+	}
+	cnt := 0
+	for len(b) != 0 {
+		if len(w.buf) == 0 && len(b) >= maxChunk {
+			// 缓冲为空时大块数据直接写出
+			n := len(b) - len(b)%maxChunk
+			m, err := w.flush(b[:n])
+			cnt += m
+			if err != nil {
+				return cnt, err
+			}
+			b = b[n:]
+			continue
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, maxChunk)
+		}
+		n := maxChunk - len(w.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+		w.buf = append(w.buf, b[:n]...)
+		cnt += n
+		b = b[n:]
+		if len(w.buf) == maxChunk {
+			if _, err := w.flush(w.buf); err != nil {
+				return cnt, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return cnt, nil
+}
+
+// 写出剩余数据和 EOB
+func (w *BlockWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.p.wraw {
+		return ETE
+	}
+	b := w.buf
+	w.buf = nil
+	if !w.started {
+		_, err := w.p.WriteBlock(b)
+		return err
+	}
+	if len(b) != 0 {
+		if _, err := w.flush(b); err != nil {
+			return err
+		}
+	}
+	if w.z != nil {
+		z := w.z
+		w.z = nil
+		if err := z.Close(); err != nil {
+			return err
+		}
+	}
+	_, err := w.p.FOB()
+	return err
+}
+
+// 放弃这个 block，如果已经有数据写出，通知对端丢弃已收到的部分。
+// 对端读取时会得到 ErrBlockAborted。
+func (w *BlockWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.buf = nil
+	if w.z != nil {
+		w.z.d.free()
+		w.z = nil
+	}
+	if !w.started {
+		return nil
+	}
+	_, err := w.p.abort()
+	return err
+}
+
+func (w *BlockWriter) flush(b []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.z = w.p.streamDeflate()
+	}
+	if w.z != nil {
+		return w.z.Write(b)
+	}
+	return w.p.write(0, b, false)
+}
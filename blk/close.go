@@ -0,0 +1,122 @@
+package blk
+
+import (
+	"io"
+	"time"
+)
+
+// Close 等待对端 Close 信号的默认时间
+const DefaultCloseTimeout = 5 * time.Second
+
+// 写 Close 信号，之后的写入返回 io.ErrClosedPipe，读取不受影响。
+// 正在发送 block 时 Close 信号在 block 结束或放弃后写出，对端不会在 block 中间读到 Close 信号。
+// 对端读到 Close 信号时得到 io.EOF，没有 Close 信号的流结束是 io.ErrUnexpectedEOF。
+func (p *Blk) CloseWrite() error {
+	q := p.lock()
+	defer p.unlock(q)
+	if p.werr == io.ErrClosedPipe {
+		return nil
+	}
+	if p.wmid {
+		p.wclose = true
+		return nil
+	}
+	return p.shut()
+}
+
+// 调用者需持有 wmu
+func (p *Blk) shut() error {
+	p.wclose = false
+	_, err := p.rawWrite(_CLOSE)
+	if err == nil {
+		p.werr = io.ErrClosedPipe
+		p.event(EventClose, DirWrite, 0)
+	}
+	return err
+}
+
+// 设置 Close 等待对端 Close 信号的时间，d 小于等于 0 时不等待
+func (p *Blk) SetCloseTimeout(d time.Duration) *Blk {
+	p.ctimeout = d
+	return p
+}
+
+// 关闭 Blk。停止心跳并写 Close 信号，然后读取并丢弃对端的数据，
+// 直到读到对端的 Close 信号或者超时，最后关闭 r 和 w 中实现了 io.Closer 的对象。
+// 对端正常关闭时返回 nil，超时返回 ErrTimeout，连接中断返回 io.ErrUnexpectedEOF。
+// 超时需要 r 实现 SetReadDeadline 或 io.Closer。
+// Close 会读取数据，不能与其他读取同时进行。有 goroutine 在读取时应该使用 CloseWrite，
+// 由读取的 goroutine 在读到 io.EOF 后关闭连接。
+func (p *Blk) Close() error {
+	p.KeepAlive(0, 0, nil)
+	var err error
+	if p.ctimeout <= 0 || p.rerr == io.EOF {
+		err = p.CloseWrite()
+	} else {
+		// 同时读写，避免两端都在写时阻塞
+		werr := make(chan error, 1)
+		go func() {
+			werr <- p.CloseWrite()
+		}()
+		deadline := time.Now().Add(p.ctimeout)
+		err = p.drain(deadline)
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case e := <-werr:
+			if err == nil {
+				err = e
+			}
+		case <-t.C:
+			// 写入阻塞，关闭连接后返回
+			defer func() { <-werr }()
+		}
+		t.Stop()
+	}
+	p.closeConn()
+	return err
+}
+
+// 关闭 r 和 w 中实现了 io.Closer 的对象
+func (p *Blk) closeConn() {
+	if c, ok := p.w.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := p.r.(io.Closer); ok && interface{}(p.r) != interface{}(p.w) {
+		c.Close()
+	}
+}
+
+// 丢弃读到的数据直到对端的 Close 信号或者 deadline
+func (p *Blk) drain(deadline time.Time) error {
+	expired := make(chan struct{})
+	d, ok := p.r.(readDeadliner)
+	if !ok || d.SetReadDeadline(deadline) != nil {
+		if c, ok := p.r.(io.Closer); ok {
+			t := time.AfterFunc(time.Until(deadline), func() {
+				close(expired)
+				c.Close()
+			})
+			defer t.Stop()
+		}
+	}
+	b := make([]byte, 512)
+	for {
+		_, err := p.read(b)
+		switch err.(type) {
+		case nil, *ChecksumError:
+			continue
+		}
+		switch err {
+		case FOB, FOM, ErrBlockAborted:
+			continue
+		case io.EOF:
+			return nil
+		}
+		select {
+		case <-expired:
+			return ErrTimeout
+		default:
+		}
+		return err
+	}
+}
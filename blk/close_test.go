@@ -0,0 +1,76 @@
+package blk
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseWrite(t *testing.T) {
+	a, b := tcpPair(t)
+	go func() {
+		a.WriteBlock([]byte("x"))
+		a.CloseWrite()
+	}()
+	buf := make([]byte, 10)
+	if n, err := b.ReadBlock(buf); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.ReadBlock(buf); err != io.EOF {
+			t.Fatal(i, err)
+		}
+	}
+	if _, err := a.WriteBlock(buf); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	// 对端已经发送了 Close 信号，b.Close 不用等待
+	done := make(chan error, 1)
+	go func() { done <- b.Close() }()
+	if _, err := a.ReadBlock(buf); err != io.EOF {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 没有 Close 信号时连接断开是截断
+func TestCloseTruncated(t *testing.T) {
+	c1, c2 := net.Pipe()
+	a, b := NewBlk(c1, c1), NewBlk(c2, c2)
+	go func() {
+		a.Write([]byte("abc"))
+		c1.Close()
+	}()
+	if _, err := b.ReadBlock(make([]byte, 10)); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+}
+
+// 两端同时 Close，其中一端还有数据在传送
+func TestCloseBoth(t *testing.T) {
+	a, b := tcpPair(t)
+	go a.WriteBlock(make([]byte, 1<<20))
+	done := make(chan error, 1)
+	go func() { done <- a.Close() }()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 对端一直不发送 Close 信号
+func TestCloseTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	a := NewBlk(c1, c1).SetCloseTimeout(50 * time.Millisecond)
+	go io.Copy(io.Discard, c2)
+	start := time.Now()
+	if err := a.Close(); err != ErrTimeout || time.Since(start) > time.Second {
+		t.Fatal(err, time.Since(start))
+	}
+}
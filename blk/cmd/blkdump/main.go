@@ -0,0 +1,414 @@
+// blkdump 解析截获的 blk 数据流，按顺序输出每个标记的偏移量和内容，
+// 并检查违反协议的地方。
+//
+//	blkdump [-q] [-x dir] [-rec R|W] [file]
+//
+// 没有 file 时从标准输入读取。-rec 表示输入是 Blk.Record 的记录文件，
+// 分析其中读到(R)或写出(W)的数据流。每行输出的格式为
+//
+//	offset  event  detail
+//
+// offset 是标记在流中的十六进制偏移量。违反协议的地方以 "!" 开头，
+// 发现违反协议时退出码为 1。
+//
+// -x 把每个 block 的数据写到 dir 中的单独文件，文件名为 block-<序号>，
+// 压缩的 block 被解压，加密的 block 保存原始的记录并使用 .sealed 后缀，
+// 被放弃的 block 不保存。
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/achun/foo/blk"
+)
+
+// 与 blk 包相同的标记和属性字
+const (
+	flagClose     = 0
+	flagAbort     = 65531
+	flagAttr      = 65532
+	flagFOM       = 65533
+	flagHeartBeat = 65534
+	flagEOB       = 65535
+
+	attrFlate  = 1 << 0
+	attrGzip   = 1 << 1
+	attrSum    = 1 << 2
+	attrSeal   = 1 << 3
+	attrAccept = 1 << 15
+
+	attrCompress = attrFlate | attrGzip
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func main() {
+	quiet := flag.Bool("q", false, "只输出违反协议的地方和统计")
+	dir := flag.String("x", "", "把每个 block 的数据保存到这个目录")
+	rec := flag.String("rec", "", "输入是记录文件，分析 R 读到或 W 写出的数据")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: blkdump [-q] [-x dir] [-rec R|W] [file]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *rec {
+	case "":
+	case "R", "W":
+		rp, err := blk.NewReplayer(in, blk.Direction((*rec)[0]), 0)
+		if err != nil {
+			fatal(err)
+		}
+		in = rp
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *dir != "" {
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			fatal(err)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	d := &dumper{r: bufio.NewReader(in), w: out, quiet: *quiet, dir: *dir}
+	err := d.run()
+	out.Flush()
+	if err != nil {
+		fatal(err)
+	}
+	if d.bad != 0 {
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "blkdump:", err)
+	os.Exit(2)
+}
+
+// 正在接收的 block
+type block struct {
+	seq    int
+	chunks int
+	size   int64
+	attr   uint16 // 描述 block 的属性字
+	crc    uint32
+	sum    bool // 已经读到校验和，之后必须是 EOB
+	mixin  bool // FOM 之后插入的 block
+	data   bytes.Buffer
+}
+
+type dumper struct {
+	r     *bufio.Reader
+	w     io.Writer
+	quiet bool
+	dir   string
+
+	off    int64    // 已读取的字节数
+	cur    *block   // 正在接收的 block，nil 表示在 block 之间
+	stack  []*block // FOM 打断的 block
+	mixin  bool     // 读到 FOM，下一个 block 是插入的
+	closed bool     // 读到 Close 信号
+
+	blocks, aborted, beats int
+	bad                    int // 违反协议的次数
+}
+
+func (d *dumper) event(at int64, name, format string, a ...interface{}) {
+	if !d.quiet {
+		fmt.Fprintf(d.w, "%08x  %-9s  %s\n", at, name, fmt.Sprintf(format, a...))
+	}
+}
+
+func (d *dumper) violate(at int64, format string, a ...interface{}) {
+	d.bad++
+	fmt.Fprintf(d.w, "%08x  ! %s\n", at, fmt.Sprintf(format, a...))
+}
+
+// 读取 n 字节，返回实际读到的数据
+func (d *dumper) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	m, err := io.ReadFull(d.r, b)
+	d.off += int64(m)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return b[:m], err
+}
+
+func (d *dumper) run() error {
+	for {
+		at := d.off
+		h, err := d.read(2)
+		if err == io.EOF {
+			if len(h) != 0 {
+				d.violate(at, "truncated flag")
+			}
+			d.end(at)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.closed {
+			d.violate(at, "data after close")
+			d.closed = false
+		}
+		f := int(h[0])<<8 | int(h[1])
+		if d.cur != nil && d.cur.sum && f != flagEOB {
+			d.violate(at, "checksum not followed by eob in block %d", d.cur.seq)
+			d.cur.sum = false
+		}
+		switch f {
+		case flagClose:
+			d.event(at, "close", "")
+			if d.cur != nil {
+				d.violate(at, "close inside block %d", d.cur.seq)
+				d.drop()
+			}
+			d.closed = true
+		case flagAbort:
+			if d.cur == nil {
+				d.violate(at, "abort outside block")
+				continue
+			}
+			b := d.cur
+			d.aborted++
+			d.event(at, "abort", "block %d, %d chunks, %d bytes discarded", b.seq, b.chunks, b.size)
+			d.pop()
+		case flagAttr:
+			if err = d.attr(at); err != nil {
+				return err
+			}
+		case flagFOM:
+			d.event(at, "fom", "")
+			d.stack = append(d.stack, d.cur)
+			d.cur = nil
+			d.mixin = true
+		case flagHeartBeat:
+			d.beats++
+			d.event(at, "heartbeat", "")
+		case flagEOB:
+			if err = d.eob(at); err != nil {
+				return err
+			}
+		default:
+			if err = d.chunk(at, f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 开始或继续 block
+func (d *dumper) open() *block {
+	if d.cur == nil {
+		d.blocks++
+		d.cur = &block{seq: d.blocks, mixin: d.mixin}
+		d.mixin = false
+	}
+	return d.cur
+}
+
+// 结束 block，回到被 FOM 打断的 block
+func (d *dumper) pop() {
+	d.cur = nil
+	if n := len(d.stack); n != 0 {
+		d.cur = d.stack[n-1]
+		d.stack = d.stack[:n-1]
+	}
+}
+
+// 丢弃所有未结束的 block
+func (d *dumper) drop() {
+	d.cur, d.stack, d.mixin = nil, nil, false
+}
+
+func (d *dumper) chunk(at int64, size int) error {
+	b := d.open()
+	data, err := d.read(size)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	b.chunks++
+	b.size += int64(len(data))
+	b.crc = crc32.Update(b.crc, castagnoli, data)
+	if d.dir != "" {
+		b.data.Write(data)
+	}
+	d.event(at, "chunk", "%d bytes, block %d", size, b.seq)
+	if len(data) < size {
+		d.violate(at, "truncated chunk, %d of %d bytes", len(data), size)
+	}
+	return nil
+}
+
+func (d *dumper) attr(at int64) error {
+	h, err := d.read(2)
+	if err == io.EOF {
+		d.violate(at, "truncated attribute")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a := uint16(h[0])<<8 | uint16(h[1])
+	switch {
+	case a&attrAccept != 0:
+		d.event(at, "accept", "%s", attrNames(a&^attrAccept))
+	case a == attrSum:
+		b := d.open()
+		c, err := d.read(4)
+		if err == io.EOF {
+			d.violate(at, "truncated checksum")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		want := uint32(c[0])<<24 | uint32(c[1])<<16 | uint32(c[2])<<8 | uint32(c[3])
+		b.sum = true
+		switch {
+		case b.attr&attrSeal != 0:
+			d.event(at, "checksum", "%08x, block %d", want, b.seq)
+		case want == b.crc:
+			d.event(at, "checksum", "%08x ok, block %d", want, b.seq)
+		default:
+			d.event(at, "checksum", "%08x, block %d", want, b.seq)
+			d.violate(at, "checksum mismatch in block %d, data %08x", b.seq, b.crc)
+		}
+	default:
+		if d.cur != nil {
+			d.violate(at, "attribute %04x inside block %d", a, d.cur.seq)
+		}
+		b := d.open()
+		b.attr = a
+		detail := attrNames(a)
+		if a&attrSeal != 0 {
+			k, err := d.read(9)
+			if err == io.EOF {
+				d.violate(at, "truncated seal header")
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			detail += fmt.Sprintf(" key %d sid %s", k[0], hex.EncodeToString(k[1:]))
+		}
+		d.event(at, "attr", "%s, block %d", detail, b.seq)
+		if a&^(attrCompress|attrSeal) != 0 || a&attrCompress == attrCompress {
+			d.violate(at, "invalid attribute %04x", a)
+		}
+	}
+	return nil
+}
+
+func (d *dumper) eob(at int64) error {
+	b := d.open()
+	kind := "block"
+	if b.mixin {
+		kind = "mixin block"
+	}
+	d.event(at, "eob", "%s %d, %d chunks, %d bytes", kind, b.seq, b.chunks, b.size)
+	d.pop()
+	if d.dir != "" {
+		return d.save(at, b)
+	}
+	return nil
+}
+
+// 保存 block 的数据
+func (d *dumper) save(at int64, b *block) error {
+	name := filepath.Join(d.dir, fmt.Sprintf("block-%06d", b.seq))
+	data := b.data.Bytes()
+	var z io.Reader
+	switch {
+	case b.attr&attrSeal != 0:
+		name += ".sealed"
+	case b.attr&attrFlate != 0:
+		z = flate.NewReader(bytes.NewReader(data))
+	case b.attr&attrGzip != 0:
+		g, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			d.violate(at, "block %d: %v", b.seq, err)
+			name += ".gz"
+		} else {
+			z = g
+		}
+	}
+	if z != nil {
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(z); err != nil {
+			d.violate(at, "block %d: %v", b.seq, err)
+			name += ".raw"
+		} else {
+			data = buf.Bytes()
+		}
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// 流结束
+func (d *dumper) end(at int64) {
+	if d.cur != nil {
+		d.violate(at, "stream ends inside block %d", d.cur.seq)
+	} else if d.mixin {
+		d.violate(at, "stream ends after fom")
+	}
+	if !d.closed {
+		d.event(at, "end", "no close signal")
+	}
+	fmt.Fprintf(d.w, "%d bytes, %d blocks, %d aborted, %d heartbeats, %d violations\n",
+		d.off, d.blocks, d.aborted, d.beats, d.bad)
+}
+
+func attrNames(a uint16) string {
+	var s []string
+	for _, n := range []struct {
+		bit  uint16
+		name string
+	}{
+		{attrFlate, "flate"},
+		{attrGzip, "gzip"},
+		{attrSum, "sum"},
+		{attrSeal, "seal"},
+	} {
+		if a&n.bit != 0 {
+			s = append(s, n.name)
+			a &^= n.bit
+		}
+	}
+	if a != 0 {
+		s = append(s, fmt.Sprintf("%04x", a))
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, " ")
+}
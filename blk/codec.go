@@ -0,0 +1,222 @@
+package blk
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// 编解码器，每次编码一个值，结果不依赖之前编码过的值
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	GobCodec  Codec = gobCodec{}
+	JSONCodec Codec = jsonCodec{}
+)
+
+var ErrUnknownType = errors.New("blk: unknown message type") // error: 没有处理这个类型的函数，消息被丢弃
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// 消息类型，实现此接口的类型使用 MessageType 的返回值作为类型标记，
+// 否则使用类型名称，例如 "main.Ping"。T 和 *T 的类型标记相同。
+// MessageType 在零值上调用，返回值只能依赖于类型。
+type Typer interface {
+	MessageType() string
+}
+
+// 返回类型 t 的值的类型标记
+func typeTag(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if m, ok := reflect.New(t).Interface().(Typer); ok {
+		return m.MessageType()
+	}
+	return t.String()
+}
+
+// 每个值编码为一个 block
+type Encoder struct {
+	p *Blk
+	c Codec
+}
+
+// c 为 nil 时使用 GobCodec
+func NewEncoder(p *Blk, c Codec) *Encoder {
+	if c == nil {
+		c = GobCodec
+	}
+	return &Encoder{p: p, c: c}
+}
+
+// 编码 v 并写为一个 block
+func (e *Encoder) Encode(v interface{}) error {
+	b, err := e.c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.p.WriteBlock(b)
+	return err
+}
+
+// 编码带类型标记的 v，接收端用 Decoder.Dispatch 按类型分发，v 不能是 nil
+//
+//	len(tag)[1] tag data
+func (e *Encoder) Send(v interface{}) error {
+	if v == nil {
+		return errors.New("blk: cannot send nil message")
+	}
+	tag := typeTag(reflect.TypeOf(v))
+	if len(tag) > 255 {
+		return fmt.Errorf("blk: message type %q too long", tag)
+	}
+	b, err := e.c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m := make([]byte, 1+len(tag)+len(b))
+	m[0] = byte(len(tag))
+	copy(m[1:], tag)
+	copy(m[1+len(tag):], b)
+	_, err = e.p.WriteBlock(m)
+	return err
+}
+
+// 从 block 解码值
+type Decoder struct {
+	p   *Blk
+	c   Codec
+	buf bytes.Buffer
+
+	mu       sync.Mutex
+	handlers map[string]handler
+}
+
+type handler struct {
+	fn  reflect.Value
+	arg reflect.Type
+}
+
+// c 为 nil 时使用 GobCodec
+func NewDecoder(p *Blk, c Codec) *Decoder {
+	if c == nil {
+		c = GobCodec
+	}
+	return &Decoder{p: p, c: c, handlers: map[string]handler{}}
+}
+
+// 读取下一个 block 并解码到 v
+func (d *Decoder) Decode(v interface{}) error {
+	if err := d.next(); err != nil {
+		return err
+	}
+	return d.c.Unmarshal(d.buf.Bytes(), v)
+}
+
+func (d *Decoder) next() error {
+	r, err := d.p.NextBlock()
+	if err != nil {
+		return err
+	}
+	d.buf.Reset()
+	_, err = d.buf.ReadFrom(r)
+	return err
+}
+
+// 注册消息处理函数，fn 的形式为 func(T) 或 func(T) error，T 是消息的类型。
+// 同一类型标记的处理函数会被替换，fn 的形式不对时 panic。
+func (d *Decoder) Handle(fn interface{}) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() > 1 ||
+		t.NumOut() == 1 && t.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		panic("blk: handler must be func(T) or func(T) error")
+	}
+	arg := t.In(0)
+	d.mu.Lock()
+	d.handlers[typeTag(arg)] = handler{fn: v, arg: arg}
+	d.mu.Unlock()
+}
+
+// 读取一个带类型标记的消息，解码后调用对应的处理函数，返回处理函数的错误。
+// 没有对应的处理函数时消息被丢弃并返回 ErrUnknownType。
+func (d *Decoder) Dispatch() error {
+	if err := d.next(); err != nil {
+		return err
+	}
+	b := d.buf.Bytes()
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return ErrProtocol
+	}
+	tag := string(b[1 : 1+int(b[0])])
+	d.mu.Lock()
+	h, ok := d.handlers[tag]
+	d.mu.Unlock()
+	if !ok {
+		return ErrUnknownType
+	}
+	t := h.arg
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v := reflect.New(t)
+	if err := d.c.Unmarshal(b[1+int(b[0]):], v.Interface()); err != nil {
+		return err
+	}
+	if h.arg.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	out := h.fn.Call([]reflect.Value{v})
+	if len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
+
+// 循环调用 Dispatch，直到读取出错或处理函数返回错误，ErrUnknownType 被忽略。
+// 对端关闭时返回 nil。
+func (d *Decoder) Serve() error {
+	for {
+		err := d.Dispatch()
+		if err == ErrUnknownType {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package blk
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type cPing struct{ N int }
+
+type cPong struct{ S string }
+
+func (cPong) MessageType() string { return "pong" }
+
+type cBig struct{ B []byte }
+
+func TestCodec(t *testing.T) {
+	for _, c := range []Codec{nil, JSONCodec} {
+		c1, c2 := net.Pipe()
+		w, r := NewBlk(c1, c1), NewBlk(c2, c2)
+		e, d := NewEncoder(w, c), NewDecoder(r, c)
+		errs := make(chan error, 1)
+		go func() {
+			e.Encode(cPing{7})
+			e.Encode(cBig{make([]byte, 100000)})
+			errs <- e.Send(nil)
+			e.Send(&cPing{1})
+			e.Send(cPong{"x"})
+			e.Send(cBig{[]byte("big")})
+			e.Send(cPing{2})
+			e.Send(cPong{"boom"})
+			e.Send(cPong{"last"})
+			w.CloseWrite()
+		}()
+		var p cPing
+		if err := d.Decode(&p); err != nil || p.N != 7 {
+			t.Fatal(err, p)
+		}
+		var big cBig
+		if err := d.Decode(&big); err != nil || len(big.B) != 100000 {
+			t.Fatal(err, len(big.B))
+		}
+		if err := <-errs; err == nil {
+			t.Fatal("Send(nil)")
+		}
+		var got []interface{}
+		d.Handle(func(p cPing) { got = append(got, p) })
+		d.Handle(func(p *cPong) error {
+			got = append(got, *p)
+			if p.S == "boom" {
+				return errors.New("boom")
+			}
+			return nil
+		})
+		if err := d.Dispatch(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Dispatch(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Dispatch(); err != ErrUnknownType {
+			t.Fatal(err)
+		}
+		if err := d.Serve(); err == nil || err.Error() != "boom" {
+			t.Fatal(err)
+		}
+		// 同一类型标记的处理函数被替换
+		d.Handle(func(p cPong) { got = append(got, p) })
+		if err := d.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		want := []interface{}{cPing{1}, cPong{"x"}, cPing{2}, cPong{"boom"}, cPong{"last"}}
+		if len(got) != len(want) {
+			t.Fatal(got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatal(i, got)
+			}
+		}
+	}
+}
+
+func TestCodecTag(t *testing.T) {
+	if tag := typeTag(reflect.TypeOf(cPong{})); tag != "pong" {
+		t.Fatal(tag)
+	}
+	if tag := typeTag(reflect.TypeOf(&cPing{})); tag != "blk.cPing" {
+		t.Fatal(tag)
+	}
+	c1, c2 := net.Pipe()
+	w, r := NewBlk(c1, c1), NewBlk(c2, c2)
+	go func() {
+		// 类型标记比 block 长
+		w.WriteBlock([]byte{5, 'p'})
+		w.WriteBlock([]byte{})
+		w.CloseWrite()
+	}()
+	d := NewDecoder(r, nil)
+	if err := d.Dispatch(); err != ErrProtocol {
+		t.Fatal(err)
+	}
+	if err := d.Serve(); err != ErrProtocol {
+		t.Fatal(err)
+	}
+	if err := d.Dispatch(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
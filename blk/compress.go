@@ -0,0 +1,266 @@
+package blk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// 压缩方法
+const (
+	CompressNone = iota
+	CompressFlate
+	CompressGzip
+)
+
+// 默认压缩阈值，小于此值的 block 不压缩
+const DefaultCompressThreshold = 1024
+
+// 启用压缩，method 为 CompressNone 时不压缩。
+// 调用时会向对端声明本端可以接收压缩的 block，只有收到对端的声明后才会压缩发送，
+// 因此未启用压缩的对端不会收到压缩的 block。
+// 65532 标记需要对端也使用支持它的版本，所以声明只在 Handshake 之后写出，
+// 没有握手的连接不会压缩，在 Handshake 之前调用时由握手协商是否压缩。
+// WriteBlock 和 BlockWriter 写出的不小于 threshold 的 block 会被压缩，
+// threshold 小于等于 0 时使用 DefaultCompressThreshold。
+// 压缩的 block 在读取时自动解压。
+func (p *Blk) SetCompress(method, threshold int) *Blk {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	p.csend, p.cmin = method, threshold
+	p.announce(attrCompress)
+	return p
+}
+
+// 当前 block 的解压器
+type inflater struct {
+	cr chunkReader
+	fl io.ReadCloser
+	gz *gzip.Reader
+	br *bufio.Reader
+}
+
+// 开始解压当前 block
+func (p *Blk) inflate(method uint16) error {
+	z := p.inflat
+	if z == nil {
+		z = &inflater{cr: chunkReader{p: p}}
+		p.inflat = z
+	}
+	z.cr.eof = false
+	var r io.Reader
+	switch method {
+	case attrFlate:
+		if z.fl == nil {
+			z.fl = flate.NewReader(&z.cr)
+		} else {
+			z.fl.(flate.Resetter).Reset(&z.cr, nil)
+		}
+		r = z.fl
+	case attrGzip:
+		var err error
+		if z.gz == nil {
+			z.gz, err = gzip.NewReader(&z.cr)
+		} else {
+			err = z.gz.Reset(&z.cr)
+		}
+		if err != nil {
+			return p.undecode(err)
+		}
+		r = z.gz
+	default:
+		return p.violation()
+	}
+	if z.br == nil {
+		z.br = bufio.NewReader(r)
+	} else {
+		z.br.Reset(r)
+	}
+	p.dec = z.br
+	return nil
+}
+
+func (p *Blk) decode(b []byte) (int, error) {
+	n, err := p.dec.Read(b)
+	if n != 0 {
+		return n, nil
+	}
+	return 0, p.undecode(err)
+}
+
+// 结束解压，解压器读完时丢弃 block 剩余的数据并返回 FOB。
+// 解压器不能在读取超时后继续，超时时之后的 head 丢弃 block 剩余的数据并返回 ErrBlockAborted。
+func (p *Blk) undecode(err error) error {
+	p.dec = nil
+	if err == ErrTimeout {
+		p.skip = ErrBlockAborted
+		return err
+	}
+	if err == io.EOF {
+		if _, err = io.Copy(io.Discard, &p.inflat.cr); err == nil {
+			err = FOB
+		} else if err == ErrTimeout {
+			p.skip = FOB
+		}
+	} else if err == io.ErrUnexpectedEOF && p.rerr == nil {
+		// 压缩数据在 block 结束前中断
+		err = p.violation()
+	}
+	return err
+}
+
+// 读取一个 block 的原始 chunk 数据，读到 FOB 时返回 io.EOF
+type chunkReader struct {
+	p   *Blk
+	eof bool
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+	for {
+		err := r.p.next()
+		switch err {
+		case nil:
+			return r.p.data(b)
+		case FOB:
+			r.eof = true
+			return 0, io.EOF
+		case errAttr:
+			// 压缩的 block 中只能出现声明和校验
+			if r.p.rattr&attrAccept == 0 && r.p.rattr != attrSum {
+				return 0, r.p.violation()
+			}
+			err = r.p.attr()
+			if err == nil {
+				continue
+			}
+			if err == FOB {
+				r.eof = true
+				return 0, io.EOF
+			}
+		case io.EOF:
+			return 0, io.ErrUnexpectedEOF
+		case FOM:
+			return 0, r.p.violation()
+		}
+		return 0, err
+	}
+}
+
+// 压缩 block 使用的缓冲和压缩器
+type deflater struct {
+	attr uint16
+	buf  bytes.Buffer
+	fl   *flate.Writer
+	gz   *gzip.Writer
+}
+
+var deflaters = sync.Pool{New: func() interface{} { return new(deflater) }}
+
+func (d *deflater) free() {
+	deflaters.Put(d)
+}
+
+// 返回对端可以接收的压缩属性，不压缩时返回 0
+func (p *Blk) compressAttr() uint16 {
+	var a uint16
+	switch p.csend {
+	case CompressFlate:
+		a = attrFlate
+	case CompressGzip:
+		a = attrGzip
+	}
+	if p.wraw || uint16(atomic.LoadInt32(&p.peer))&a == 0 {
+		return 0
+	}
+	return a
+}
+
+// 压缩 b，不需要压缩或者压缩无效时返回 nil
+func (p *Blk) deflate(b []byte) *deflater {
+	if len(b) < p.cmin {
+		return nil
+	}
+	a := p.compressAttr()
+	if a == 0 {
+		return nil
+	}
+	d := deflaters.Get().(*deflater)
+	d.buf.Reset()
+	w := d.writer(a, &d.buf)
+	w.Write(b)
+	w.Close()
+	if d.buf.Len() >= len(b) {
+		d.free()
+		return nil
+	}
+	d.attr = a
+	return d
+}
+
+func (d *deflater) writer(a uint16, w io.Writer) io.WriteCloser {
+	if a == attrGzip {
+		if d.gz == nil {
+			d.gz = gzip.NewWriter(w)
+		} else {
+			d.gz.Reset(w)
+		}
+		return d.gz
+	}
+	if d.fl == nil {
+		d.fl, _ = flate.NewWriter(w, flate.DefaultCompression)
+	} else {
+		d.fl.Reset(w)
+	}
+	return d.fl
+}
+
+// BlockWriter 使用的流式压缩，输出按 chunk 写出
+type streamDeflater struct {
+	d  *deflater
+	z  io.WriteCloser
+	bw *bufio.Writer
+}
+
+// 开始流式压缩一个 block，不需要压缩时返回 nil
+func (p *Blk) streamDeflate() *streamDeflater {
+	a := p.compressAttr()
+	if a == 0 {
+		return nil
+	}
+	s := &streamDeflater{d: deflaters.Get().(*deflater)}
+	s.bw = bufio.NewWriterSize(&chunkWriter{p: p, attr: a}, maxChunk)
+	s.z = s.d.writer(a, s.bw)
+	return s
+}
+
+func (s *streamDeflater) Write(b []byte) (int, error) {
+	return s.z.Write(b)
+}
+
+func (s *streamDeflater) Close() error {
+	defer s.d.free()
+	if err := s.z.Close(); err != nil {
+		return err
+	}
+	return s.bw.Flush()
+}
+
+// 写出 chunk，第一次写出时带上属性字
+type chunkWriter struct {
+	p    *Blk
+	attr uint16
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	a := w.attr
+	w.attr = 0
+	return w.p.write(a, b, false)
+}
@@ -0,0 +1,114 @@
+package blk
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testDoc(n int) []byte {
+	var doc bytes.Buffer
+	for i := 0; doc.Len() < n; i++ {
+		fmt.Fprintf(&doc, `{"id":%d,"name":"item %d","tags":["a","b"]},`, i, i)
+	}
+	return doc.Bytes()
+}
+
+// 没有握手时不写出属性声明，旧版本的对端读到的数据流不变
+func TestAnnounceNeedsHandshake(t *testing.T) {
+	var w bytes.Buffer
+	p := NewBlk(nil, &w)
+	p.SetCompress(CompressFlate, 0)
+	p.SetChecksum(true)
+	if _, err := p.WriteBlock([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0xFF, 0xFF}
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("% x", w.Bytes())
+	}
+}
+
+type timeoutWriter struct {
+	bytes.Buffer
+	fail int
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if w.fail > 0 {
+		w.fail--
+		return 0, ErrTimeout
+	}
+	return w.Buffer.Write(b)
+}
+
+// 写出声明超时后在下一个 block 之前重试
+func TestAnnounceRetry(t *testing.T) {
+	w := &timeoutWriter{fail: 1}
+	p := NewBlk(nil, w)
+	p.vers = Version
+	p.SetCompress(CompressFlate, 0)
+	if w.Len() != 0 {
+		t.Fatalf("% x", w.Bytes())
+	}
+	if _, err := p.WriteBlock([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xFF, 0xFC, 0x80, attrCompress, 0, 1, 'x', 0xFF, 0xFF}
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("% x", w.Bytes())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	doc := testDoc(200000)
+	for _, m := range []int{CompressFlate, CompressGzip} {
+		a, b := tcpPair(t)
+		handshake(t, a, b, Hello{Compress: m}, Hello{Compress: m})
+		go func() {
+			a.WriteBlock(doc)
+			bw := a.NewBlockWriter()
+			bw.Write(doc)
+			bw.Close()
+			a.WriteBlock([]byte("small"))
+			bw = a.NewBlockWriter()
+			bw.Write(doc[:100])
+			bw.Close()
+		}()
+		for i, want := range [][]byte{doc, doc, []byte("small"), doc[:100]} {
+			if got := readAll(t, b); !bytes.Equal(got, want) {
+				t.Fatal(m, i, len(got))
+			}
+		}
+		if n := b.Stats().BytesIn; n > uint64(len(doc)) {
+			t.Fatal(m, "not compressed", n)
+		}
+	}
+}
+
+// 握手之后启用压缩，两端读到对方的声明后压缩发送
+func TestCompressAfterHandshake(t *testing.T) {
+	doc := testDoc(100000)
+	a, b := tcpPair(t)
+	handshake(t, a, b, Hello{}, Hello{})
+	a.SetCompress(CompressGzip, 0)
+	b.SetCompress(CompressFlate, 0)
+	go a.WriteBlock([]byte("ping"))
+	if got := readAll(t, b); string(got) != "ping" {
+		t.Fatalf("%q", got)
+	}
+	go b.WriteBlock(doc)
+	if got := readAll(t, a); !bytes.Equal(got, doc) {
+		t.Fatal(len(got))
+	}
+	go a.WriteBlock(doc)
+	if got := readAll(t, b); !bytes.Equal(got, doc) {
+		t.Fatal(len(got))
+	}
+	if n := a.Stats().BytesIn; n > uint64(len(doc)) {
+		t.Fatal("a received uncompressed", n)
+	}
+	if n := b.Stats().BytesIn; n > uint64(len(doc)) {
+		t.Fatal("b received uncompressed", n)
+	}
+}
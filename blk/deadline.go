@@ -0,0 +1,168 @@
+package blk
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 读写超时，实现了 net.Error，Timeout() 返回 true
+var ErrTimeout error = timeoutError{}
+
+var ErrNoDeadline = errors.New("blk: deadline not supported") // error: r 或 w 没有实现 SetReadDeadline/SetWriteDeadline
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "blk: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func isTimeout(err error) bool {
+	e, ok := err.(interface{ Timeout() bool })
+	return ok && e.Timeout()
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// 设置读取的截止时间，零值表示不超时。r 需要实现 SetReadDeadline，例如 net.Conn。
+// 超时返回 ErrTimeout，已经读取的数据有效，之后可以继续读取。
+// 超时发生在压缩的 block 中间时，block 的其余部分被丢弃，下一次读取返回 ErrBlockAborted。
+func (p *Blk) SetReadDeadline(t time.Time) error {
+	d, ok := p.r.(readDeadliner)
+	if !ok {
+		return ErrNoDeadline
+	}
+	p.rdl = t
+	return d.SetReadDeadline(t)
+}
+
+// 设置写入的截止时间，零值表示不超时。w 需要实现 SetWriteDeadline，例如 net.Conn。
+// 超时返回 ErrTimeout。没有数据写出时 Blk 的状态不变，可以重试；
+// 否则被截断的 chunk 在之后的写入时补全，block 被放弃，对端读到 ErrBlockAborted。
+func (p *Blk) SetWriteDeadline(t time.Time) error {
+	d, ok := p.w.(writeDeadliner)
+	if !ok {
+		return ErrNoDeadline
+	}
+	p.wmu.Lock()
+	p.wdl = t
+	p.wmu.Unlock()
+	return d.SetWriteDeadline(t)
+}
+
+// 同时设置读取和写入的截止时间
+func (p *Blk) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+// 与 ReadBlock 相同，ctx 结束时返回 ctx.Err()，已经读取的数据有效，之后可以继续读取。
+// r 没有实现 SetReadDeadline 时 ctx 只在开始时检查。
+func (p *Blk) ReadBlockContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d, ok := p.r.(readDeadliner)
+	if !ok || ctx.Done() == nil {
+		return p.ReadBlock(b)
+	}
+	stop := watch(ctx, d.SetReadDeadline, p.rdl)
+	n, err := p.ReadBlock(b)
+	stop()
+	return n, ctxErr(ctx, err)
+}
+
+// 与 WriteBlock 相同，ctx 结束时返回 ctx.Err()，Blk 的状态与写超时相同。
+// 等待其他写入释放写锁时 ctx 结束也返回 ctx.Err()，这时没有写出任何数据。
+// w 没有实现 SetWriteDeadline 时 ctx 只在开始和等待写锁时检查。
+func (p *Blk) WriteBlockContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.writeBlock(ctx, b)
+}
+
+// 很早以前的时间，用来中断阻塞的读写
+var aLongTimeAgo = time.Unix(1, 0)
+
+// 按 ctx 设置截止时间，ctx 结束时中断阻塞的读写。
+// 返回的函数停止监视并恢复原来的截止时间 base。
+func watch(ctx context.Context, set func(time.Time) error, base time.Time) func() {
+	if t, ok := ctx.Deadline(); ok && (base.IsZero() || t.Before(base)) {
+		set(t)
+	}
+	done := make(chan struct{})
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		select {
+		case <-ctx.Done():
+			set(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exit
+		set(base)
+	}
+}
+
+// ctx 结束引起的超时返回 ctx.Err()
+func ctxErr(ctx context.Context, err error) error {
+	if err != ErrTimeout {
+		return err
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if t, ok := ctx.Deadline(); ok && !time.Now().Before(t) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// 写超时后补全被截断的 chunk。
+// vec 中 hdr 之前是属性标记，之后是成对的 chunk 头和数据，eob 为 true 时最后是 block 结束标记，
+// n 是已经写出的字节数。返回 true 表示 block 结束标记已经开始写出，block 是完整的，
+// 否则在补全的数据之后放弃 block。调用者需持有 wmu
+func (p *Blk) cut(vec net.Buffers, n, hdr int, eob bool) bool {
+	var rest []byte
+	done := false
+	for i, v := range vec {
+		if n >= len(v) {
+			n -= len(v)
+			continue
+		}
+		last := eob && i == len(vec)-1
+		head := i >= hdr && (i-hdr)%2 == 0 && !last
+		if n == 0 && (head || i < hdr || last) {
+			// 在 chunk 边界上
+			break
+		}
+		rest = append(rest, v[n:]...)
+		if head {
+			rest = append(rest, vec[i+1]...)
+		}
+		done = last
+		break
+	}
+	if !done {
+		rest = append(rest, _ABORT...)
+		atomic.AddUint64(&p.st.abortsOut, 1)
+		p.event(EventAbort, DirWrite, p.wsize)
+		p.wmid, p.wcrc = false, 0
+	}
+	p.wrest = rest
+	return done
+}
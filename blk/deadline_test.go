@@ -0,0 +1,191 @@
+package blk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 读取超时后继续读取同一个 block
+func TestReadTimeoutResume(t *testing.T) {
+	doc := bytes.Repeat([]byte("0123456789"), 5000)
+	for _, mode := range []string{"plain", "checksum", "seal"} {
+		w, r := tcpPair(t)
+		switch mode {
+		case "checksum":
+			handshake(t, w, r, Hello{Checksum: true}, Hello{})
+		case "seal":
+			w.AddSealKey(1, sealKey1)
+			r.AddSealKey(1, sealKey1)
+		}
+		w.SetChunkSize(1000)
+		go func() {
+			w.Write(doc[:20000])
+			time.Sleep(150 * time.Millisecond)
+			w.Write(doc[20000:])
+			w.FOB()
+		}()
+		buf := make([]byte, len(doc))
+		r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := r.ReadBlock(buf)
+		if err != ErrTimeout {
+			t.Fatal(mode, n, err)
+		}
+		r.SetReadDeadline(time.Time{})
+		m, err := r.ReadBlock(buf[n:])
+		if err != nil || !bytes.Equal(buf[:n+m], doc) {
+			t.Fatal(mode, n, m, err)
+		}
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	w, r := tcpPair(t)
+	buf := make([]byte, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := r.ReadBlockContext(ctx, buf); err != context.Canceled {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadBlockContext(ctx, buf); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	go w.WriteBlock([]byte("hello"))
+	n, err := r.ReadBlockContext(context.Background(), buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal(n, err)
+	}
+}
+
+// 没有写出数据时超时不改变 Blk 的状态
+func TestWriteContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w, r := NewBlk(c1, c1), NewBlk(c2, c2)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := w.WriteBlockContext(ctx, []byte("x")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	go w.WriteBlock([]byte("after"))
+	buf := make([]byte, 100)
+	n, err := r.ReadBlock(buf)
+	if err != nil || string(buf[:n]) != "after" {
+		t.Fatal(n, err)
+	}
+}
+
+// 写出部分数据后超时，对端读到 ErrBlockAborted，之后的 block 正常
+func TestWriteTimeoutPartial(t *testing.T) {
+	for _, seal := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		w, r := NewBlk(c1, c1), NewBlk(c2, c2)
+		if seal {
+			w.AddSealKey(1, sealKey1)
+			r.AddSealKey(1, sealKey1)
+		}
+		w.SetChunkSize(1000)
+		// 只读取 1500 字节，截断第二个 chunk
+		raw := make([]byte, 1500)
+		got := make(chan struct{})
+		go func() {
+			io.ReadFull(c2, raw)
+			close(got)
+		}()
+		w.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := w.WriteBlock(bytes.Repeat([]byte("a"), 5000))
+		if err != ErrTimeout || n != 0 {
+			t.Fatal(seal, n, err)
+		}
+		<-got
+		w.SetWriteDeadline(time.Time{})
+		go w.WriteBlock([]byte("next"))
+		r.r = io.MultiReader(bytes.NewReader(raw), c2)
+		buf := make([]byte, 10000)
+		if _, err = r.ReadBlock(buf); err != ErrBlockAborted {
+			t.Fatal(seal, err)
+		}
+		n, err = r.ReadBlock(buf)
+		if err != nil || string(buf[:n]) != "next" {
+			t.Fatal(seal, n, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// 压缩的 block 读取超时后被放弃
+func TestCompressedTimeout(t *testing.T) {
+	w, r := tcpPair(t)
+	handshake(t, w, r, Hello{Compress: CompressGzip}, Hello{Compress: CompressFlate})
+	doc := make([]byte, 400000)
+	rand.Read(doc)
+	go func() {
+		bw := w.NewBlockWriter()
+		bw.Write(doc[:len(doc)/2])
+		time.Sleep(100 * time.Millisecond)
+		bw.Write(doc[len(doc)/2:])
+		bw.Close()
+		w.WriteBlock([]byte("next"))
+	}()
+	buf := make([]byte, len(doc))
+	r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := r.ReadBlock(buf); err != ErrTimeout {
+		t.Fatal(n, err)
+	}
+	r.SetReadDeadline(time.Time{})
+	if _, err := r.ReadBlock(buf); err != ErrBlockAborted {
+		t.Fatal(err)
+	}
+	n, err := r.ReadBlock(buf)
+	if err != nil || string(buf[:n]) != "next" {
+		t.Fatal(n, err)
+	}
+}
+
+// 另一个写入阻塞并持有写锁时，WriteBlockContext 在 ctx 结束时返回
+func TestWriteContextLocked(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		w := NewBlk(c1, c1).SetFair(fair)
+		go w.WriteBlock([]byte("stuck"))
+		time.Sleep(10 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.WriteBlockContext(ctx, []byte("x"))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != context.DeadlineExceeded {
+				t.Fatal(fair, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal(fair, "blocked on the write lock")
+		}
+		cancel()
+		// 锁释放后仍然可以写入
+		r := NewBlk(c2, c2)
+		go w.WriteBlock([]byte("after"))
+		buf := make([]byte, 10)
+		for _, want := range []string{"stuck", "after"} {
+			n, err := r.ReadBlock(buf)
+			if err != nil || string(buf[:n]) != want {
+				t.Fatal(fair, string(buf[:n]), err)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,164 @@
+package blk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// 协议版本
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// 本版本支持的属性
+const helloCaps = attrCompress | attrSum
+
+var ErrHandshake = errors.New("blk: handshake failed") // error: 对端没有发送握手 block
+
+// 协议版本不兼容
+type VersionError struct {
+	Local, Peer [2]int // 版本范围 MinVersion, Version
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("blk: incompatible protocol version, local %d..%d peer %d..%d",
+		e.Local[0], e.Local[1], e.Peer[0], e.Peer[1])
+}
+
+// 握手参数
+type Hello struct {
+	Version   int           // 协商后的协议版本，发送时忽略
+	ChunkSize int           // 最大 chunk，0 表示使用当前设置，协商结果取两端较小值
+	Compress  int           // 发送时使用的压缩方法，两端都要求压缩时启用，各自使用自己的方法，CompressNone 表示使用 SetCompress 的设置
+	Checksum  bool          // 任一端要求时两端都启用校验，false 表示使用 SetChecksum 的设置
+	HeartBeat time.Duration // 心跳间隔，协商结果取两端非 0 的较小值，超时为间隔的 3 倍
+}
+
+// 握手 block
+//	magic[3] "blk" version[1] minVersion[1] caps[2] chunk[2] compress[1] checksum[1] heartbeat[4](毫秒)
+// 之后的数据留给以后的版本，被忽略。
+const helloSize = 15
+
+// 与对端交换握手 block，协商协议版本和参数，并按协商结果设置 Blk。
+// 必须是连接上的第一个 block，两端都要调用。返回协商后的参数。
+// 对端发送的第一个 block 不是握手 block 时返回 ErrHandshake，版本不兼容时返回 *VersionError。
+// 读取对端的握手 block 失败时不等待本端的握手 block 写完就返回，之后连接不能再使用，应该关闭。
+func (p *Blk) Handshake(h Hello) (Hello, error) {
+	if h.ChunkSize <= 0 {
+		h.ChunkSize = p.csz
+	}
+	if h.ChunkSize > maxChunk {
+		h.ChunkSize = maxChunk
+	}
+	if h.Compress == CompressNone {
+		h.Compress = p.csend
+	}
+	p.wmu.Lock()
+	h.Checksum = h.Checksum || p.sum
+	p.wmu.Unlock()
+	b := make([]byte, helloSize)
+	copy(b, "blk")
+	b[3], b[4] = Version, MinVersion
+	b[5], b[6] = byte(helloCaps>>8), byte(helloCaps)
+	b[7], b[8] = byte(h.ChunkSize>>8), byte(h.ChunkSize)
+	b[9] = byte(h.Compress)
+	if h.Checksum {
+		b[10] = 1
+	}
+	ms := uint32(h.HeartBeat / time.Millisecond)
+	b[11], b[12], b[13], b[14] = byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+
+	// 同时读写，避免两端都在写时阻塞
+	werr := make(chan error, 1)
+	go func() {
+		_, err := p.WriteBlock(b)
+		werr <- err
+	}()
+	r := make([]byte, helloSize)
+	err := p.readHello(r)
+	if err != nil {
+		// 对端不是 blk 或者连接已经中断，可能不会读取本端的握手 block，不能等待写入完成
+		return h, err
+	}
+	if err = <-werr; err != nil {
+		return h, err
+	}
+	pv, pmin := int(r[3]), int(r[4])
+	if pv < MinVersion || pmin > Version {
+		return h, &VersionError{Local: [2]int{MinVersion, Version}, Peer: [2]int{pmin, pv}}
+	}
+	h.Version = Version
+	if pv < h.Version {
+		h.Version = pv
+	}
+	pcaps := int32(r[5])<<8 | int32(r[6])
+	if n := int(r[7])<<8 | int(r[8]); n != 0 && n < h.ChunkSize {
+		h.ChunkSize = n
+	}
+	if r[9] == CompressNone {
+		h.Compress = CompressNone
+	}
+	h.Checksum = h.Checksum || r[10] != 0
+	pms := time.Duration(uint32(r[11])<<24|uint32(r[12])<<16|uint32(r[13])<<8|uint32(r[14])) * time.Millisecond
+	if h.HeartBeat <= 0 || pms > 0 && pms < h.HeartBeat {
+		h.HeartBeat = pms
+	}
+	p.apply(h, pcaps)
+	return h, nil
+}
+
+// 按协商结果设置 Blk，对端的属性已知，不需要再声明。
+// 握手之前 SetCompress 设置的阈值和声明过的属性被保留。
+func (p *Blk) apply(h Hello, pcaps int32) {
+	var acc, peer int32
+	p.SetChunkSize(h.ChunkSize)
+	if h.Compress != CompressNone {
+		p.csend = h.Compress
+		if p.cmin <= 0 {
+			p.cmin = DefaultCompressThreshold
+		}
+		acc |= attrCompress
+		peer |= pcaps & attrCompress
+	}
+	p.wmu.Lock()
+	p.sum = h.Checksum
+	p.pend = false
+	p.wmu.Unlock()
+	if h.Checksum {
+		acc |= attrSum
+		peer |= pcaps & attrSum
+	}
+	p.accept(acc)
+	atomic.StoreInt32(&p.peer, peer)
+	atomic.StoreInt32(&p.vers, int32(h.Version))
+	if h.HeartBeat > 0 {
+		p.KeepAlive(h.HeartBeat, 3*h.HeartBeat, nil)
+	}
+}
+
+// 读取对端的握手 block 到 r，丢弃超过 helloSize 的部分
+func (p *Blk) readHello(r []byte) error {
+	br, err := p.NextBlock()
+	if err == ETE {
+		return ErrHandshake
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(br, r); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrHandshake
+	}
+	if err != nil {
+		return err
+	}
+	if string(r[:3]) != "blk" {
+		return ErrHandshake
+	}
+	_, err = io.Copy(io.Discard, br)
+	p.cur = nil
+	return err
+}
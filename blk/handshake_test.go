@@ -0,0 +1,117 @@
+package blk
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	a, b := tcpPair(t)
+	ha, hb := handshake(t, a, b,
+		Hello{Compress: CompressFlate, Checksum: true, HeartBeat: 200 * time.Millisecond},
+		Hello{ChunkSize: 4000, Compress: CompressGzip, HeartBeat: time.Second})
+	defer a.KeepAlive(0, 0, nil)
+	defer b.KeepAlive(0, 0, nil)
+	if ha.Version != Version || ha.ChunkSize != 4000 || hb.ChunkSize != 4000 ||
+		!ha.Checksum || !hb.Checksum ||
+		ha.HeartBeat != 200*time.Millisecond || hb.HeartBeat != ha.HeartBeat ||
+		ha.Compress != CompressFlate || hb.Compress != CompressGzip {
+		t.Fatalf("%+v %+v", ha, hb)
+	}
+	doc := testDoc(300000)
+	go func() {
+		a.WriteBlock(doc)
+		b.WriteBlock(doc)
+	}()
+	if got := readAll(t, b); !bytes.Equal(got, doc) {
+		t.Fatal(len(got))
+	}
+	if got := readAll(t, a); !bytes.Equal(got, doc) {
+		t.Fatal(len(got))
+	}
+}
+
+// 握手之前的 SetChecksum 和 SetCompress 不被空的 Hello 关闭
+func TestHandshakeKeepsSettings(t *testing.T) {
+	a, b := tcpPair(t)
+	a.SetChecksum(true).SetCompress(CompressGzip, 100)
+	b.SetCompress(CompressFlate, 0)
+	ha, hb := handshake(t, a, b, Hello{}, Hello{})
+	if !ha.Checksum || !hb.Checksum || ha.Compress != CompressGzip || hb.Compress != CompressFlate {
+		t.Fatalf("%+v %+v", ha, hb)
+	}
+	if a.cmin != 100 || b.cmin != DefaultCompressThreshold {
+		t.Fatal(a.cmin, b.cmin)
+	}
+	for _, p := range []*Blk{a, b} {
+		if p.acc != attrCompress|attrSum || p.peer != attrCompress|attrSum {
+			t.Fatal(p.acc, p.peer)
+		}
+	}
+	doc := testDoc(300000)
+	go a.WriteBlock(doc)
+	if got := readAll(t, b); !bytes.Equal(got, doc) {
+		t.Fatal(len(got))
+	}
+	if n := a.Stats().BytesOut; n > uint64(len(doc))/2 {
+		t.Fatal("not compressed", n)
+	}
+}
+
+// 对端不是 blk 并且不读取，同步的连接上也不能阻塞
+func TestHandshakeNotBlk(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go NewBlk(c2, c2).WriteBlock([]byte("hello there, not a handshake"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewBlk(c1, c1).Handshake(Hello{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrHandshake {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handshake blocked")
+	}
+}
+
+// 以后的版本的握手 block 更长，多出的部分被忽略
+func TestHandshakeLongHello(t *testing.T) {
+	a, b := tcpPair(t)
+	hello := make([]byte, helloSize+5000)
+	copy(hello, "blk")
+	hello[3], hello[4] = Version+1, MinVersion
+	go func() {
+		b.WriteBlock(hello)
+		b.NextBlock()
+		b.WriteBlock([]byte("next"))
+	}()
+	h, err := a.Handshake(Hello{})
+	if err != nil || h.Version != Version {
+		t.Fatal(h, err)
+	}
+	if got := readAll(t, a); string(got) != "next" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	a, b := tcpPair(t)
+	hello := make([]byte, helloSize)
+	copy(hello, "blk")
+	hello[3], hello[4] = Version+2, Version+1
+	go func() {
+		b.WriteBlock(hello)
+		b.NextBlock()
+	}()
+	_, err := a.Handshake(Hello{})
+	if e, ok := err.(*VersionError); !ok || e.Peer != [2]int{Version + 1, Version + 2} {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package blk
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDead = errors.New("blk: peer is dead") // error: 心跳超时
+
+// 启用心跳。每隔 interval 写一次心跳信号，
+// 超过 timeout 没有读到任何数据(包括对端的心跳)就认为对端已失效，
+// 此时停止心跳并调用 onDead(ErrDead)，之后的读写都返回 ErrDead。
+// 如果 onDead 为 nil 并且 r 实现了 io.Closer，则关闭 r，以便解除阻塞的读取。
+// 只有读取时才能发现数据到达，所以启用 timeout 时要保持有 goroutine 在读取。
+// timeout 为 0 表示不检测对端，interval 为 0 表示停止心跳。
+func (p *Blk) KeepAlive(interval, timeout time.Duration, onDead func(error)) *Blk {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if interval <= 0 {
+		return p
+	}
+	p.stop = make(chan struct{})
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+	go p.keepAlive(p.stop, interval, timeout, onDead)
+	return p
+}
+
+func (p *Blk) keepAlive(stop chan struct{}, interval, timeout time.Duration, onDead func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if timeout > 0 && time.Now().UnixNano()-atomic.LoadInt64(&p.last) > int64(timeout) {
+			atomic.StoreInt32(&p.dead, 1)
+			if onDead != nil {
+				onDead(ErrDead)
+			} else if c, ok := p.r.(io.Closer); ok {
+				c.Close()
+			}
+			return
+		}
+		if p.beat() != nil {
+			return
+		}
+	}
+}
+
+// 写心跳信号，原始流模式下跳过
+func (p *Blk) beat() error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if p.wraw {
+		return nil
+	}
+	_, err := p.rawWrite(_HEARTBEAT)
+	if err == nil {
+		atomic.AddUint64(&p.st.beatsOut, 1)
+		p.event(EventHeartBeat, DirWrite, 0)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package blk
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// 收到的心跳不被回应
+func TestHeartBeatNoEcho(t *testing.T) {
+	a, b := tcpPair(t)
+	a.KeepAlive(5*time.Millisecond, 0, nil)
+	defer a.KeepAlive(0, 0, nil)
+	go b.NextBlock()
+	go a.NextBlock()
+	time.Sleep(100 * time.Millisecond)
+	if sb := b.Stats(); sb.HeartBeatsIn < 5 || sb.HeartBeatsOut != 0 {
+		t.Fatalf("%+v", sb)
+	}
+	if sa := a.Stats(); sa.HeartBeatsIn != 0 {
+		t.Fatalf("%+v", sa)
+	}
+}
+
+// 对端不发送任何数据时被认为已失效
+func TestKeepAliveDead(t *testing.T) {
+	for _, callback := range []bool{true, false} {
+		a, b := tcpPair(t)
+		go b.NextBlock()
+		dead := make(chan error, 2)
+		var onDead func(error)
+		if callback {
+			onDead = func(err error) { dead <- err }
+		}
+		a.KeepAlive(10*time.Millisecond, 50*time.Millisecond, onDead)
+		read := make(chan error, 1)
+		go func() {
+			_, err := a.NextBlock()
+			read <- err
+		}()
+		if callback {
+			select {
+			case err := <-dead:
+				if err != ErrDead {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("onDead not called")
+			}
+			// 没有 onDead 时才会自动关闭 r
+			a.r.(io.Closer).Close()
+		}
+		select {
+		case err := <-read:
+			if err != ErrDead {
+				t.Fatal(callback, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal(callback, "read blocked")
+		}
+		if _, err := a.WriteBlock([]byte("x")); err != ErrDead {
+			t.Fatal(callback, err)
+		}
+		if _, err := a.NextBlock(); err != ErrDead {
+			t.Fatal(callback, err)
+		}
+		// 心跳已经停止
+		n := a.Stats().HeartBeatsOut
+		time.Sleep(50 * time.Millisecond)
+		if a.Stats().HeartBeatsOut != n || len(dead) != 0 {
+			t.Fatal(callback, "still beating")
+		}
+	}
+}
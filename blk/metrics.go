@@ -0,0 +1,203 @@
+package blk
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// block 大小直方图各区间的上限，最后一个区间没有上限
+var sizeBounds = [...]int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+const sizeBuckets = len(sizeBounds) + 1
+
+// 连接的统计，In 是读到的，Out 是写出的
+type Stats struct {
+	BytesIn, BytesOut           uint64 // 原始数据流的字节数
+	ChunksIn, ChunksOut         uint64
+	BlocksIn, BlocksOut         uint64 // 完整的 block，包括 FOM 之后插入的 block
+	HeartBeatsIn, HeartBeatsOut uint64
+	FOMIn, FOMOut               uint64
+	AbortsIn, AbortsOut         uint64 // 被放弃的 block
+
+	ChecksumErrors uint64 // 校验失败
+	SealErrors     uint64 // 加密 block 认证失败，重放或没有对应的密钥
+	ProtocolErrors uint64 // 数据流不符合协议
+	Timeouts       uint64 // 读写超时
+	ReadErrors     uint64 // 其他读取错误，包括没有 Close 信号的连接中断
+	WriteErrors    uint64 // 其他写入错误
+
+	// block 大小的直方图，大小是 block 中 chunk 数据的总和，即压缩或加密之后的大小。
+	// 各区间的上限依次为 64，256，1K，4K，16K，64K，256K，1M，最后一个区间没有上限。
+	BlockSizesIn, BlockSizesOut [sizeBuckets]uint64
+}
+
+func (s *Stats) add(o *Stats) {
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+	s.ChunksIn += o.ChunksIn
+	s.ChunksOut += o.ChunksOut
+	s.BlocksIn += o.BlocksIn
+	s.BlocksOut += o.BlocksOut
+	s.HeartBeatsIn += o.HeartBeatsIn
+	s.HeartBeatsOut += o.HeartBeatsOut
+	s.FOMIn += o.FOMIn
+	s.FOMOut += o.FOMOut
+	s.AbortsIn += o.AbortsIn
+	s.AbortsOut += o.AbortsOut
+	s.ChecksumErrors += o.ChecksumErrors
+	s.SealErrors += o.SealErrors
+	s.ProtocolErrors += o.ProtocolErrors
+	s.Timeouts += o.Timeouts
+	s.ReadErrors += o.ReadErrors
+	s.WriteErrors += o.WriteErrors
+	for i := range s.BlockSizesIn {
+		s.BlockSizesIn[i] += o.BlockSizesIn[i]
+		s.BlockSizesOut[i] += o.BlockSizesOut[i]
+	}
+}
+
+// Blk 内部的计数器，原子操作
+type counters struct {
+	bytesIn, bytesOut   uint64
+	chunksIn, chunksOut uint64
+	blocksIn, blocksOut uint64
+	beatsIn, beatsOut   uint64
+	fomIn, fomOut       uint64
+	abortsIn, abortsOut uint64
+	sealErrs            uint64
+	protoErrs           uint64
+	timeouts            uint64
+	readErrs            uint64
+	writeErrs           uint64
+	sizesIn, sizesOut   [sizeBuckets]uint64
+}
+
+// 记录一个大小为 n 的 block
+func observe(h *[sizeBuckets]uint64, n int) {
+	i := 0
+	for i < len(sizeBounds) && n > sizeBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h[i], 1)
+}
+
+func load(h *[sizeBuckets]uint64) (s [sizeBuckets]uint64) {
+	for i := range h {
+		s[i] = atomic.LoadUint64(&h[i])
+	}
+	return
+}
+
+// 返回连接的统计，可以与读写同时调用
+func (p *Blk) Stats() Stats {
+	c := p.st
+	return Stats{
+		BytesIn:        atomic.LoadUint64(&c.bytesIn),
+		BytesOut:       atomic.LoadUint64(&c.bytesOut),
+		ChunksIn:       atomic.LoadUint64(&c.chunksIn),
+		ChunksOut:      atomic.LoadUint64(&c.chunksOut),
+		BlocksIn:       atomic.LoadUint64(&c.blocksIn),
+		BlocksOut:      atomic.LoadUint64(&c.blocksOut),
+		HeartBeatsIn:   atomic.LoadUint64(&c.beatsIn),
+		HeartBeatsOut:  atomic.LoadUint64(&c.beatsOut),
+		FOMIn:          atomic.LoadUint64(&c.fomIn),
+		FOMOut:         atomic.LoadUint64(&c.fomOut),
+		AbortsIn:       atomic.LoadUint64(&c.abortsIn),
+		AbortsOut:      atomic.LoadUint64(&c.abortsOut),
+		ChecksumErrors: atomic.LoadUint64(&p.sumErrs),
+		SealErrors:     atomic.LoadUint64(&c.sealErrs),
+		ProtocolErrors: atomic.LoadUint64(&c.protoErrs),
+		Timeouts:       atomic.LoadUint64(&c.timeouts),
+		ReadErrors:     atomic.LoadUint64(&c.readErrs),
+		WriteErrors:    atomic.LoadUint64(&c.writeErrs),
+		BlockSizesIn:   load(&c.sizesIn),
+		BlockSizesOut:  load(&c.sizesOut),
+	}
+}
+
+// 计数并返回 ErrProtocol
+func (p *Blk) violation() error {
+	atomic.AddUint64(&p.st.protoErrs, 1)
+	return ErrProtocol
+}
+
+// 按名称登记连接，汇总统计并通过 expvar 发布。
+//
+//	reg := blk.NewRegistry()
+//	reg.Publish("blk")
+//	srv := &blk.Server{Handler: h, Registry: reg}
+type Registry struct {
+	mu    sync.Mutex
+	conns map[*Blk]string
+	gone  Stats // 已经移除的连接的统计
+}
+
+func NewRegistry() *Registry {
+	return &Registry{conns: map[*Blk]string{}}
+}
+
+// 登记连接，name 用于 Stats 返回的结果，可以重复
+func (r *Registry) Add(name string, p *Blk) {
+	r.mu.Lock()
+	r.conns[p] = name
+	r.mu.Unlock()
+}
+
+// 移除连接，连接的统计计入 Total
+func (r *Registry) Remove(p *Blk) {
+	r.mu.Lock()
+	if _, ok := r.conns[p]; ok {
+		delete(r.conns, p)
+		s := p.Stats()
+		r.gone.add(&s)
+	}
+	r.mu.Unlock()
+}
+
+// 返回登记的连接数
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// 返回每个登记的连接的统计，同名的连接合并在一起
+func (r *Registry) Stats() map[string]Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]Stats, len(r.conns))
+	for p, name := range r.conns {
+		s := m[name]
+		o := p.Stats()
+		s.add(&o)
+		m[name] = s
+	}
+	return m
+}
+
+// 返回所有连接的统计总和，包括已经移除的连接
+func (r *Registry) Total() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.gone
+	for p := range r.conns {
+		o := p.Stats()
+		s.add(&o)
+	}
+	return s
+}
+
+// 以 name 发布到 expvar，内容为连接数和统计总和
+//
+//	{"Conns": 2, "Total": {...}}
+//
+// name 已经发布过时 panic。
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return struct {
+			Conns int
+			Total Stats
+		}{r.Len(), r.Total()}
+	}))
+}
@@ -0,0 +1,101 @@
+package blk
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// 写出已知的数据流，返回两端
+func statsStream(t *testing.T) (a, b *Blk) {
+	var buf bytes.Buffer
+	a = NewBlk(nil, &buf).SetChunkSize(DefaultChunkSize)
+	a.WriteBlock(make([]byte, 100))   // 2+100+2
+	a.WriteBlock(make([]byte, 40000)) // 3 个 chunk，3*2+40000+2
+	a.HeartBeat()                     // 2
+	a.FOM()                           // 2
+	a.WriteBlock([]byte("mix"))       // 2+3+2
+	a.Write([]byte("x"))              // 2+1
+	a.AbortBlock()                    // 2
+	a.CloseWrite()                    // 2
+	b = NewBlk(&buf, io.Discard)
+	rb := make([]byte, 50000)
+	for _, want := range []error{nil, nil, FOM, nil, ErrBlockAborted, io.EOF} {
+		if _, err := b.ReadBlock(rb); err != want {
+			t.Fatal(err, want)
+		}
+	}
+	return a, b
+}
+
+func TestStats(t *testing.T) {
+	a, b := statsStream(t)
+	var sizes [sizeBuckets]uint64
+	sizes[0], sizes[1], sizes[5] = 1, 1, 1
+	want := Stats{
+		BytesOut:      40130,
+		ChunksOut:     6,
+		BlocksOut:     3,
+		HeartBeatsOut: 1,
+		FOMOut:        1,
+		AbortsOut:     1,
+		BlockSizesOut: sizes,
+	}
+	if s := a.Stats(); s != want {
+		t.Fatalf("%+v", s)
+	}
+	want = Stats{
+		BytesIn:      40130,
+		ChunksIn:     6,
+		BlocksIn:     3,
+		HeartBeatsIn: 1,
+		FOMIn:        1,
+		AbortsIn:     1,
+		BlockSizesIn: sizes,
+	}
+	if s := b.Stats(); s != want {
+		t.Fatalf("%+v", s)
+	}
+}
+
+var published int
+
+func TestRegistry(t *testing.T) {
+	a, b := statsStream(t)
+	c, _ := statsStream(t)
+	reg := NewRegistry()
+	reg.Add("out", a)
+	reg.Add("out", c)
+	reg.Add("in", b)
+	m := reg.Stats()
+	if len(m) != 2 || m["out"].BlocksOut != 6 || m["out"].BytesOut != 2*40130 || m["in"].BlocksIn != 3 {
+		t.Fatalf("%+v", m)
+	}
+	reg.Remove(c)
+	reg.Remove(c)
+	reg.Remove(b)
+	if reg.Len() != 1 {
+		t.Fatal(reg.Len())
+	}
+	s := reg.Total()
+	if s.BlocksOut != 6 || s.BlocksIn != 3 || s.BytesOut != 2*40130 || s.BlockSizesOut[5] != 2 || s.BlockSizesIn[5] != 1 {
+		t.Fatalf("%+v", s)
+	}
+	// 同一名称只能发布一次，-count 大于 1 时每次使用不同的名称
+	published++
+	name := fmt.Sprint("blktest", published)
+	reg.Publish(name)
+	var v struct {
+		Conns int
+		Total Stats
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Conns != 1 || v.Total != s {
+		t.Fatalf("%+v", v)
+	}
+}
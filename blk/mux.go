@@ -0,0 +1,379 @@
+package blk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Mux 在一个 Blk 上复用多个独立的逻辑流(stream)。
+// 每个帧都以 FOM 标记开头，随后是一个 block:
+//
+//	frame type[1] id[4] data
+//	type
+//		muxSyn  打开流
+//		muxData 流数据
+//		muxWnd  窗口更新，data 为 uint32 增量
+//		muxFin  关闭流
+//
+// 发送端按帧轮流发送各流的数据，每个流有独立的接收窗口，
+// 读取慢的流不会阻塞其他流。
+type Mux struct {
+	blk     *Blk
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	next    uint32 //下一个本地流 ID
+	accept  chan *stream
+	wq      chan *muxFrame
+	die     chan struct{}
+	err     error //Mux 关闭原因
+	once    sync.Once
+}
+
+const (
+	muxSyn byte = iota
+	muxData
+	muxWnd
+	muxFin
+)
+
+const (
+	muxHeadSize  = 5
+	muxFrameSize = 16 << 10  // 每帧最大数据量
+	muxWindow    = 256 << 10 // 每个流的接收窗口
+	muxBacklog   = 64        // 等待 AcceptStream 的流数量
+)
+
+var ErrMuxProtocol = errors.New("blk: mux protocol error")
+
+type muxFrame struct {
+	typ  byte
+	id   uint32
+	data []byte
+	done chan error
+}
+
+// 在 p 上创建 Mux。连接两端必须一端 client 为 true，另一端为 false，
+// 以保证双方分配的流 ID 不冲突。
+// Mux 独占 p 的读写，关闭底层连接由调用者负责。
+func NewMux(p *Blk, client bool) *Mux {
+	m := &Mux{
+		blk:     p,
+		streams: map[uint32]*stream{},
+		next:    2,
+		accept:  make(chan *stream, muxBacklog),
+		wq:      make(chan *muxFrame),
+		die:     make(chan struct{}),
+	}
+	if client {
+		m.next = 1
+	}
+	go m.recvLoop()
+	go m.sendLoop()
+	return m
+}
+
+// 打开一个新的流
+func (m *Mux) OpenStream() (io.ReadWriteCloser, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := newStream(m, m.next)
+	m.streams[s.id] = s
+	m.next += 2
+	m.mu.Unlock()
+	if err := m.write(muxSyn, s.id, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 等待对端打开的流
+func (m *Mux) AcceptStream() (io.ReadWriteCloser, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.die:
+		return nil, m.err
+	}
+}
+
+// 关闭 Mux 及其所有的流，不关闭底层连接
+func (m *Mux) Close() error {
+	m.fail(io.ErrClosedPipe)
+	return nil
+}
+
+func (m *Mux) fail(err error) {
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = map[uint32]*stream{}
+		m.mu.Unlock()
+		close(m.die)
+		for _, s := range streams {
+			s.fail(err)
+		}
+	})
+}
+
+// 提交一个帧给 sendLoop 并等待写入完成
+func (m *Mux) write(typ byte, id uint32, data []byte) error {
+	f := &muxFrame{typ: typ, id: id, data: data, done: make(chan error, 1)}
+	select {
+	case m.wq <- f:
+	case <-m.die:
+		return m.err
+	}
+	select {
+	case err := <-f.done:
+		return err
+	case <-m.die:
+		return m.err
+	}
+}
+
+// 帧按提交顺序写入，各流每次只提交一个帧，因此各流轮流发送。
+func (m *Mux) sendLoop() {
+	buf := make([]byte, muxHeadSize+muxFrameSize)
+	for {
+		var f *muxFrame
+		select {
+		case f = <-m.wq:
+		case <-m.die:
+			return
+		}
+		buf[0] = f.typ
+		buf[1] = byte(f.id >> 24)
+		buf[2] = byte(f.id >> 16)
+		buf[3] = byte(f.id >> 8)
+		buf[4] = byte(f.id)
+		n := muxHeadSize + copy(buf[muxHeadSize:], f.data)
+		_, err := m.blk.FOM()
+		if err == nil {
+			_, err = m.blk.WriteBlock(buf[:n])
+		}
+		f.done <- err
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) recvLoop() {
+	buf := make([]byte, muxHeadSize+muxFrameSize)
+	for {
+		_, err := m.blk.ReadBlock(buf)
+		if err == nil {
+			err = ErrMuxProtocol
+		}
+		if err != FOM {
+			m.fail(err)
+			return
+		}
+		n, err := m.blk.ReadBlock(buf)
+		if err == nil && n < muxHeadSize {
+			err = ErrMuxProtocol
+		}
+		if err == nil {
+			id := uint32(buf[1])<<24 | uint32(buf[2])<<16 | uint32(buf[3])<<8 | uint32(buf[4])
+			err = m.handle(buf[0], id, buf[muxHeadSize:n])
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(typ byte, id uint32, data []byte) error {
+	m.mu.Lock()
+	s := m.streams[id]
+	if typ == muxSyn {
+		if s != nil || id == 0 || id&1 == m.next&1 {
+			m.mu.Unlock()
+			return ErrMuxProtocol
+		}
+		s = newStream(m, id)
+		select {
+		case m.accept <- s:
+			m.streams[id] = s
+			m.mu.Unlock()
+		default:
+			m.mu.Unlock()
+			go m.write(muxFin, id, nil)
+		}
+		return nil
+	}
+	m.mu.Unlock()
+	if s == nil {
+		// 本端已关闭的流
+		return nil
+	}
+	switch typ {
+	case muxData:
+		return s.push(data)
+	case muxWnd:
+		if len(data) != 4 {
+			return ErrMuxProtocol
+		}
+		s.grow(int(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])))
+	case muxFin:
+		s.finish()
+	default:
+		return ErrMuxProtocol
+	}
+	return nil
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Mux 上的逻辑流
+type stream struct {
+	id     uint32
+	mux    *Mux
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer //已接收未读取的数据
+	win    int          //发送窗口
+	unack  int          //已读取但未通知对端的字节数
+	rfin   bool         //对端已关闭
+	closed bool         //本端已关闭
+	err    error
+}
+
+func newStream(m *Mux, id uint32) *stream {
+	s := &stream{id: id, mux: m, win: muxWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.rfin && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if s.buf.Len() == 0 {
+		err := s.err
+		if err == nil {
+			err = io.EOF
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.buf.Read(b)
+	s.unack += n
+	inc := 0
+	if s.unack >= muxWindow/2 && !s.rfin {
+		inc, s.unack = s.unack, 0
+	}
+	s.mu.Unlock()
+	if inc != 0 {
+		s.mux.write(muxWnd, s.id, []byte{byte(inc >> 24), byte(inc >> 16), byte(inc >> 8), byte(inc)})
+	}
+	return n, nil
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	cnt := 0
+	for cnt < len(b) {
+		s.mu.Lock()
+		for s.win == 0 && !s.rfin && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.rfin || s.closed || s.err != nil {
+			err := s.err
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+			s.mu.Unlock()
+			return cnt, err
+		}
+		n := len(b) - cnt
+		if n > s.win {
+			n = s.win
+		}
+		if n > muxFrameSize {
+			n = muxFrameSize
+		}
+		s.win -= n
+		s.mu.Unlock()
+		if err := s.mux.write(muxData, s.id, b[cnt:cnt+n]); err != nil {
+			return cnt, err
+		}
+		cnt += n
+	}
+	return cnt, nil
+}
+
+// 关闭流，对端读取完已发送的数据后得到 io.EOF
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	rfin := s.rfin
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if rfin {
+		s.mux.remove(s.id)
+	}
+	return s.mux.write(muxFin, s.id, nil)
+}
+
+func (s *stream) push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.buf.Len()+s.unack+len(data) > muxWindow {
+		return ErrMuxProtocol
+	}
+	s.buf.Write(data)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *stream) grow(n int) {
+	s.mu.Lock()
+	s.win += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *stream) finish() {
+	s.mu.Lock()
+	s.rfin = true
+	closed := s.closed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if closed {
+		s.mux.remove(s.id)
+	}
+}
+
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
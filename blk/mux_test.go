@@ -0,0 +1,145 @@
+package blk
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T) (a, b *Mux) {
+	pa, pb := tcpPair(t)
+	a, b = NewMux(pa, true), NewMux(pb, false)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// 两端同时打开多个流发送数据，接收端按第一个字节找到对应的数据比较
+func TestMux(t *testing.T) {
+	a, b := muxPair(t)
+	const N = 8
+	data := make([][]byte, N)
+	for i := range data {
+		data[i] = make([]byte, 1<<18+i*777)
+		rand.Read(data[i])
+		data[i][0] = byte(i)
+	}
+	var wg sync.WaitGroup
+	for _, m := range [][2]*Mux{{a, b}, {b, a}} {
+		open, accept := m[0], m[1]
+		for i := 0; i < N; i++ {
+			i := i
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				s, err := open.OpenStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = s.Write(data[i]); err != nil {
+					t.Error(err)
+				}
+				s.Close()
+			}()
+			go func() {
+				defer wg.Done()
+				s, err := accept.AcceptStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer s.Close()
+				got, err := io.ReadAll(s)
+				if err != nil || len(got) == 0 || !bytes.Equal(got, data[got[0]]) {
+					t.Error(len(got), err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// 不读取的流填满窗口后，其他流仍然可以发送
+func TestMuxSlowStream(t *testing.T) {
+	a, b := muxPair(t)
+	slow, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rslow, err := b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := make([]byte, muxWindow)
+	rand.Read(d)
+	if _, err = slow.Write(d); err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := slow.Write([]byte("more"))
+		blocked <- err
+	}()
+
+	fast, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfast, err := b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		fast.Write(make([]byte, 1<<20))
+		fast.Close()
+	}()
+	if n, err := io.Copy(io.Discard, rfast); n != 1<<20 || err != nil {
+		t.Fatal(n, err)
+	}
+	select {
+	case err := <-blocked:
+		t.Fatal("write beyond the window", err)
+	default:
+	}
+
+	got := make([]byte, len(d)+4)
+	if _, err = io.ReadFull(rslow, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(d)], d) || string(got[len(d):]) != "more" {
+		t.Fatal("data mismatch")
+	}
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	a, b := muxPair(t)
+	s, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Close()
+	}()
+	if _, err = s.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if _, err = a.AcceptStream(); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if _, err = a.OpenStream(); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+}
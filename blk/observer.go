@@ -0,0 +1,96 @@
+package blk
+
+import (
+	"net"
+)
+
+// 帧事件的类型
+type EventKind int
+
+const (
+	EventChunk     EventKind = iota // chunk，Size 是 chunk 数据的大小
+	EventAttr                       // 属性字，Attr 是属性字
+	EventEOB                        // block 结束，Size 是 block 中 chunk 数据的总和
+	EventFOM                        // FOM 标记
+	EventHeartBeat                  // 心跳信号
+	EventAbort                      // 放弃 block
+	EventClose                      // Close 信号
+	EventError                      // 错误被锁定，之后的读取或写入都返回 Err
+)
+
+var eventNames = [...]string{"chunk", "attr", "eob", "fom", "heartbeat", "abort", "close", "error"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[k]
+}
+
+// 帧事件，Dir 为 DirRead 表示读到的，DirWrite 表示写出的
+type Event struct {
+	Kind EventKind
+	Dir  Direction
+	Size int
+	Attr uint16
+	Err  error
+}
+
+// 接收 Blk 的帧事件，可以用来记录日志或者按 block 生成跟踪。
+// 读到的事件在读取的 goroutine 中调用，写出的事件可能在持有写锁时调用，
+// Observe 不能调用这个 Blk 的写入方法，并且应该尽快返回。
+type Observer interface {
+	Observe(p *Blk, e Event)
+}
+
+// 函数形式的 Observer
+type ObserverFunc func(p *Blk, e Event)
+
+func (f ObserverFunc) Observe(p *Blk, e Event) {
+	f(p, e)
+}
+
+// 设置帧事件的接收者，nil 表示不接收。应该在开始读写之前设置。
+func (p *Blk) SetObserver(o Observer) *Blk {
+	p.wmu.Lock()
+	p.obs = o
+	p.wmu.Unlock()
+	return p
+}
+
+func (p *Blk) event(kind EventKind, dir Direction, size int) {
+	if p.obs != nil {
+		p.obs.Observe(p, Event{Kind: kind, Dir: dir, Size: size})
+	}
+}
+
+func (p *Blk) eventAttr(dir Direction, attr uint16) {
+	if p.obs != nil {
+		p.obs.Observe(p, Event{Kind: EventAttr, Dir: dir, Attr: attr})
+	}
+}
+
+func (p *Blk) eventErr(dir Direction, err error) {
+	if p.obs != nil {
+		p.obs.Observe(p, Event{Kind: EventError, Dir: dir, Err: err})
+	}
+}
+
+// 报告 writeLocked 写出的帧，vec 的结构与 cut 相同，lead 表示 vec[0] 是属性标记
+func (p *Blk) written(vec net.Buffers, lead, eob bool) {
+	i := 0
+	if lead {
+		p.eventAttr(DirWrite, uint16(vec[0][2])<<8|uint16(vec[0][3]))
+		i = 1
+	}
+	n := len(vec)
+	if eob {
+		n--
+	}
+	for ; i+1 < n; i += 2 {
+		p.event(EventChunk, DirWrite, len(vec[i+1]))
+	}
+	if eob && p.wsum {
+		p.eventAttr(DirWrite, attrSum)
+	}
+}
@@ -0,0 +1,91 @@
+package blk
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// 记录帧事件，不包括方向
+type eventLog struct {
+	mu  sync.Mutex
+	dir Direction
+	ev  []string
+}
+
+func (l *eventLog) Observe(p *Blk, e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.Dir != l.dir {
+		l.ev = append(l.ev, fmt.Sprint("wrong direction ", e.Dir))
+	}
+	l.ev = append(l.ev, fmt.Sprint(e.Kind, " ", e.Size, " ", e.Attr))
+}
+
+// 读写两端看到相同的事件序列
+func TestObserver(t *testing.T) {
+	for _, c := range []struct {
+		mode, attr string
+		n          int // 属性字事件的数量
+	}{
+		{"plain", "", 0},
+		{"sum", "attr 0 4", 2},
+		{"seal", "attr 0 8", 3},
+	} {
+		mode := c.mode
+		a, b := tcpPair(t)
+		switch mode {
+		case "sum":
+			handshake(t, a, b, Hello{Checksum: true}, Hello{})
+		case "seal":
+			a.AddSealKey(1, sealKey1)
+			b.AddSealKey(1, sealKey1)
+		}
+		la, lb := &eventLog{dir: DirWrite}, &eventLog{dir: DirRead}
+		a.SetObserver(la).SetChunkSize(100)
+		b.SetObserver(lb)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			a.WriteBlock(make([]byte, 250))
+			a.HeartBeat()
+			a.FOM()
+			a.WriteBlock([]byte("mix"))
+			a.Write([]byte("x"))
+			a.AbortBlock()
+			a.CloseWrite()
+		}()
+		buf := make([]byte, 1000)
+		for _, want := range []error{nil, FOM, nil, ErrBlockAborted, io.EOF} {
+			if _, err := b.ReadBlock(buf); err != want {
+				t.Fatal(mode, err, want)
+			}
+		}
+		<-done
+		if !reflect.DeepEqual(la.ev, lb.ev) {
+			t.Fatal(mode, "\n", la.ev, "\n", lb.ev)
+		}
+		if c.n != 0 {
+			n := 0
+			for _, e := range la.ev {
+				if e == c.attr {
+					n++
+				}
+			}
+			if n != c.n {
+				t.Fatal(mode, la.ev)
+			}
+			continue
+		}
+		want := []string{
+			"chunk 100 0", "chunk 100 0", "chunk 50 0", "eob 250 0",
+			"heartbeat 0 0", "fom 0 0", "chunk 3 0", "eob 3 0",
+			"chunk 1 0", "abort 1 0", "close 0 0",
+		}
+		if !reflect.DeepEqual(la.ev, want) {
+			t.Fatal(la.ev)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// pubsub 在 blk 之上实现发布/订阅。
+// 客户端用控制 block 订阅主题，发布的 block 由 Broker 转发给所有匹配的订阅者。
+// 每个消息是一个 block
+//
+//	kind[1] len(topic)[1] topic payload
+//	kind
+//		kindSub   订阅，topic 是模式，没有 payload
+//		kindUnsub 取消订阅，topic 与订阅时相同
+//		kindPub   发布，Broker 转发给订阅者时格式不变
+//
+// 主题以 '.' 分段，模式中的 '*' 匹配一段，'#' 只能是最后一段，匹配之后的任意段，
+// 例如 "user.*.login" 匹配 "user.42.login"，"user.#" 匹配 "user" 和 "user.42.login"。
+package pubsub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/achun/foo/blk"
+)
+
+const (
+	kindSub byte = iota
+	kindUnsub
+	kindPub
+)
+
+// 每个订阅者的默认队列长度
+const DefaultQueueSize = 256
+
+// 客户端发送的消息的默认最大字节数
+const DefaultMaxMessageSize = 16 << 20
+
+// 断开客户端时写 Close 信号的超时
+const killTimeout = time.Second
+
+var (
+	ErrClosed   = errors.New("pubsub: broker closed")
+	ErrProtocol = errors.New("pubsub: protocol error")
+	ErrTopic    = errors.New("pubsub: invalid topic")     // error: 主题为空，超过 255 字节或者发布的主题中有通配符
+	ErrTooLarge = errors.New("pubsub: message too large") // error: 客户端发送的消息超过 Broker.MaxMessageSize
+)
+
+// 订阅者的队列满时的处理方式
+type Policy int
+
+const (
+	DropNewest Policy = iota // 丢弃新的消息
+	DropOldest               // 丢弃队列中最早的消息
+	Disconnect               // 断开订阅者的连接
+)
+
+// 消息
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// 检查 topic 是否匹配 pattern
+func Match(pattern, topic string) bool {
+	for {
+		if pattern == "#" {
+			return true
+		}
+		p, prest, pmore := cut(pattern)
+		t, trest, tmore := cut(topic)
+		if p != "*" && p != t {
+			return false
+		}
+		if !pmore || !tmore {
+			return !pmore && !tmore || pmore && prest == "#"
+		}
+		pattern, topic = prest, trest
+	}
+}
+
+// 返回第一段和其余部分，more 表示还有其余部分
+func cut(s string) (seg, rest string, more bool) {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// 检查主题，pattern 为 true 时允许通配符
+func valid(topic string, pattern bool) bool {
+	if topic == "" || len(topic) > 255 {
+		return false
+	}
+	for s, more := topic, true; more; {
+		var seg string
+		seg, s, more = cut(s)
+		if seg == "" {
+			return false
+		}
+		if seg == "*" || seg == "#" {
+			if !pattern || seg == "#" && more {
+				return false
+			}
+		} else if strings.ContainsAny(seg, "*#") {
+			return false
+		}
+	}
+	return true
+}
+
+func encode(kind byte, topic string, payload []byte) []byte {
+	b := make([]byte, 2+len(topic)+len(payload))
+	b[0], b[1] = kind, byte(len(topic))
+	copy(b[2:], topic)
+	copy(b[2+len(topic):], payload)
+	return b
+}
+
+func decode(b []byte) (kind byte, topic string, payload []byte, err error) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return 0, "", nil, ErrProtocol
+	}
+	n := 2 + int(b[1])
+	return b[0], string(b[2:n]), b[n:], nil
+}
+
+// 读取一个完整的 block，超过 max 字节时返回 ErrTooLarge，max 为 0 时不限制
+func readBlock(p *blk.Blk, max int) ([]byte, error) {
+	r, err := p.NextBlock()
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if max > 0 && buf.Len() > max {
+		return nil, ErrTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// 转发发布的消息给订阅者
+//
+//	b := &pubsub.Broker{QueueSize: 1024, Policy: pubsub.DropOldest}
+//	srv := &blk.Server{Handler: b.Serve}
+type Broker struct {
+	// 每个订阅者的队列长度，0 表示 DefaultQueueSize
+	QueueSize int
+
+	// 订阅者的队列满时的处理方式
+	Policy Policy
+
+	// 客户端发送的消息的最大字节数，包括消息头，超过时断开客户端，0 表示 DefaultMaxMessageSize
+	MaxMessageSize int
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closed  bool
+	dropped uint64 //原子操作
+}
+
+// 连接到 Broker 的客户端
+type client struct {
+	conn net.Conn
+	p    *blk.Blk
+	subs map[string]struct{} //受 Broker.mu 保护
+	q    chan []byte
+	done chan struct{}
+	gone chan struct{} //连接已经关闭
+	once sync.Once
+}
+
+// 断开客户端，不会阻塞。
+// 先写 Close 信号让客户端的 Receive 返回 io.EOF，killTimeout 内写不出去时直接关闭连接。
+func (c *client) kill() {
+	c.once.Do(func() {
+		close(c.done)
+		go func() {
+			c.conn.SetWriteDeadline(time.Now().Add(killTimeout))
+			c.p.CloseWrite()
+			c.conn.Close()
+			close(c.gone)
+		}()
+	})
+}
+
+// 处理一个客户端连接，连接结束时返回，可以用作 blk.Server 的 Handler
+func (b *Broker) Serve(conn net.Conn, p *blk.Blk) {
+	size := b.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	c := &client{
+		conn: conn,
+		p:    p,
+		subs: map[string]struct{}{},
+		q:    make(chan []byte, size),
+		done: make(chan struct{}),
+		gone: make(chan struct{}),
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if b.clients == nil {
+		b.clients = map[*client]struct{}{}
+	}
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+
+	wdone := make(chan struct{})
+	go func() {
+		defer close(wdone)
+		b.writeLoop(c)
+	}()
+	b.readLoop(c)
+	b.mu.Lock()
+	delete(b.clients, c)
+	b.mu.Unlock()
+	c.kill()
+	<-wdone
+	<-c.gone
+}
+
+func (b *Broker) readLoop(c *client) {
+	max := b.MaxMessageSize
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+	for {
+		m, err := readBlock(c.p, max)
+		if err == blk.ErrBlockAborted {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		kind, topic, _, err := decode(m)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case kindSub:
+			if !valid(topic, true) {
+				return
+			}
+			b.mu.Lock()
+			c.subs[topic] = struct{}{}
+			b.mu.Unlock()
+		case kindUnsub:
+			b.mu.Lock()
+			delete(c.subs, topic)
+			b.mu.Unlock()
+		case kindPub:
+			if !valid(topic, false) {
+				return
+			}
+			b.route(topic, m)
+		default:
+			return
+		}
+	}
+}
+
+func (b *Broker) writeLoop(c *client) {
+	for {
+		select {
+		case m := <-c.q:
+			if _, err := c.p.WriteBlock(m); err != nil {
+				c.kill()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 发布消息，返回接收到消息的订阅者数量，不包括队列满时丢弃了这个消息的订阅者
+func (b *Broker) Publish(topic string, payload []byte) (int, error) {
+	if !valid(topic, false) {
+		return 0, ErrTopic
+	}
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return 0, ErrClosed
+	}
+	return b.route(topic, encode(kindPub, topic, payload)), nil
+}
+
+// 把编码后的消息 m 放入所有匹配的订阅者的队列
+func (b *Broker) route(topic string, m []byte) int {
+	n := 0
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if !c.match(topic) {
+			continue
+		}
+		select {
+		case c.q <- m:
+			n++
+			continue
+		default:
+		}
+		atomic.AddUint64(&b.dropped, 1)
+		switch b.Policy {
+		case DropOldest:
+			select {
+			case <-c.q:
+			default:
+			}
+			select {
+			case c.q <- m:
+				n++
+			default:
+			}
+		case Disconnect:
+			delete(b.clients, c)
+			c.kill()
+		}
+	}
+	return n
+}
+
+// 调用者需持有 Broker.mu
+func (c *client) match(topic string) bool {
+	for p := range c.subs {
+		if Match(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回连接的客户端数量
+func (b *Broker) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// 返回因为队列满被丢弃的消息数量，Disconnect 时是被断开的次数
+func (b *Broker) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// 关闭 Broker 和所有客户端连接，客户端的 Receive 返回 io.EOF
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	clients := b.clients
+	b.clients = nil
+	b.mu.Unlock()
+	for c := range clients {
+		c.kill()
+	}
+	for c := range clients {
+		<-c.gone
+	}
+	return nil
+}
+
+// 连接 Broker 的客户端
+type Client struct {
+	p *blk.Blk
+}
+
+// 在 p 上创建客户端，Receive 独占 p 的读取
+func NewClient(p *blk.Blk) *Client {
+	return &Client{p: p}
+}
+
+// 订阅匹配 patterns 的主题
+func (c *Client) Subscribe(patterns ...string) error {
+	return c.control(kindSub, patterns)
+}
+
+// 取消订阅，patterns 与订阅时相同
+func (c *Client) Unsubscribe(patterns ...string) error {
+	return c.control(kindUnsub, patterns)
+}
+
+func (c *Client) control(kind byte, patterns []string) error {
+	for _, p := range patterns {
+		if !valid(p, true) {
+			return ErrTopic
+		}
+	}
+	for _, p := range patterns {
+		if _, err := c.p.WriteBlock(encode(kind, p, nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 发布消息，topic 中不能有通配符
+func (c *Client) Publish(topic string, payload []byte) error {
+	if !valid(topic, false) {
+		return ErrTopic
+	}
+	_, err := c.p.WriteBlock(encode(kindPub, topic, payload))
+	return err
+}
+
+// 读取下一个订阅的消息，Broker 关闭连接时返回 io.EOF 或者读取错误
+func (c *Client) Receive() (*Message, error) {
+	for {
+		m, err := readBlock(c.p, 0)
+		if err == blk.ErrBlockAborted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kind, topic, payload, err := decode(m)
+		if err != nil {
+			return nil, err
+		}
+		if kind != kindPub {
+			return nil, ErrProtocol
+		}
+		return &Message{Topic: topic, Payload: payload}, nil
+	}
+}
@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/achun/foo/blk"
+)
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		p, t string
+		ok   bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#", "x.y", true},
+		{"*.b.*", "a.b.c", true},
+		{"a", "a.b", false},
+		{"a.b", "a", false},
+		{"*", "a", true},
+		{"a.*.c", "a.b.d", false},
+	} {
+		if Match(c.p, c.t) != c.ok {
+			t.Error(c)
+		}
+	}
+	for _, s := range []string{"a.#.b", "a..b", "", "a*"} {
+		if valid(s, true) {
+			t.Error(s)
+		}
+	}
+	if valid("a.*", false) || !valid("a.*", true) {
+		t.Error("wildcard in published topic")
+	}
+}
+
+// 启动 Broker，返回连接它的函数
+func serve(t *testing.T, b *Broker) func() *Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &blk.Server{Handler: b.Serve}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		b.Close()
+		srv.Close()
+	})
+	return func() *Client {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return NewClient(blk.NewBlk(c, c))
+	}
+}
+
+// 等待 Broker 有 n 个客户端
+func waitLen(t *testing.T, b *Broker, n int) {
+	for i := 0; b.Len() != n; i++ {
+		if i == 5000 {
+			t.Fatal("clients", b.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 读取直到出错
+func drain(c *Client) error {
+	for {
+		if _, err := c.Receive(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := &Broker{}
+	dial := serve(t, b)
+	s1, s2, pub := dial(), dial(), dial()
+	s1.Subscribe("user.*.login")
+	s2.Subscribe("user.#")
+	waitLen(t, b, 3)
+	// 订阅和发布在不同的连接上，等待 Broker 处理完订阅
+	time.Sleep(20 * time.Millisecond)
+	pub.Publish("user.1.login", []byte("a"))
+	pub.Publish("user.1.logout", []byte("b"))
+	pub.Publish("order.1", []byte("c"))
+	m, err := s1.Receive()
+	if err != nil || m.Topic != "user.1.login" || string(m.Payload) != "a" {
+		t.Fatal(m, err)
+	}
+	for _, want := range []string{"a", "b"} {
+		m, err := s2.Receive()
+		if err != nil || string(m.Payload) != want {
+			t.Fatal(m, err)
+		}
+	}
+	if _, err := b.Publish("a.*", nil); err != ErrTopic {
+		t.Fatal(err)
+	}
+	b.Close()
+	if err := drain(s1); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := b.Publish("a", nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+// 不读取的订阅者被发布的消息塞满队列
+func TestBrokerPolicy(t *testing.T) {
+	for _, pol := range []Policy{DropNewest, DropOldest, Disconnect} {
+		b := &Broker{QueueSize: 4, Policy: pol}
+		dial := serve(t, b)
+		fast, slow := dial(), dial()
+		fast.Subscribe("x")
+		slow.Subscribe("#")
+		waitLen(t, b, 2)
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 20000; i++ {
+			b.Publish(fmt.Sprint("y.", i), make([]byte, 1000))
+		}
+		if b.Dropped() == 0 {
+			t.Fatal(pol, "nothing dropped")
+		}
+		if pol != Disconnect {
+			if b.Len() != 2 {
+				t.Fatal(pol, b.Len())
+			}
+			continue
+		}
+		if b.Len() != 1 {
+			t.Fatal(pol, b.Len())
+		}
+		// 被断开的订阅者读完收到的消息后读到 io.EOF
+		if err := drain(slow); err != io.EOF {
+			t.Fatal(err)
+		}
+		b.Publish("x", []byte("ok"))
+		if m, err := fast.Receive(); err != nil || string(m.Payload) != "ok" {
+			t.Fatal(m, err)
+		}
+	}
+}
+
+// 发送超过 MaxMessageSize 的消息的客户端被断开
+func TestBrokerMaxMessageSize(t *testing.T) {
+	b := &Broker{MaxMessageSize: 100}
+	dial := serve(t, b)
+	sub, big := dial(), dial()
+	sub.Subscribe("x")
+	waitLen(t, b, 2)
+	time.Sleep(20 * time.Millisecond)
+	// 消息头 3 字节
+	big.Publish("x", make([]byte, 97))
+	big.Publish("x", make([]byte, 98))
+	big.Publish("x", []byte("lost"))
+	if m, err := sub.Receive(); err != nil || len(m.Payload) != 97 {
+		t.Fatal(m, err)
+	}
+	if err := drain(big); err != io.EOF {
+		t.Fatal(err)
+	}
+	waitLen(t, b, 1)
+	b.Publish("x", []byte("ok"))
+	if m, err := sub.Receive(); err != nil || string(m.Payload) != "ok" {
+		t.Fatal(m, err)
+	}
+}
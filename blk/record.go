@@ -0,0 +1,236 @@
+package blk
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// 记录的数据方向
+type Direction byte
+
+const (
+	DirRead  Direction = 'R' // Blk 读到的数据
+	DirWrite Direction = 'W' // Blk 写出的数据
+)
+
+// 记录文件的格式
+//
+//	magic[8] start[8] record...
+//	record dir[1] time[8] len[4] data
+//
+// start 是开始记录时的 UnixNano，time 是数据读写完成时相对 start 的纳秒数。
+// data 是 r.Read 和 w.Write 的原始数据，同一方向的 data 连起来就是完整的数据流，
+// 包括所有的 block 和标记，可以交给 blkdump 分析。
+const recMagic = "blkrec1\n"
+
+// 一个记录的最大数据长度，Blk 每次读写的数据远小于此值
+const recMaxData = 16 << 20
+
+var ErrRecord = errors.New("blk: invalid recording") // error: 记录文件格式错误或被截断
+
+// 记录 Blk 读写的数据
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	hdr   [13]byte
+	stop  bool
+	err   error
+}
+
+// 把 p 读写的数据连同时间和方向记录到 w，返回的 Recorder 用来停止记录。
+// 应该在开始读写之前调用，之前已经读入缓冲的数据不会被记录。
+// 写 w 出错后停止记录，不影响 p 的读写，错误由 Recorder.Err 返回。
+// p 的 r 和 w 被包装，之后不再使用 writev 写出，ChunkAdaptive 也不再识别连接的类型。
+func (p *Blk) Record(w io.Writer) *Recorder {
+	rec := &Recorder{w: w, start: time.Now()}
+	h := make([]byte, 16)
+	copy(h, recMagic)
+	putSeq(h[8:], uint64(rec.start.UnixNano()))
+	_, rec.err = w.Write(h)
+
+	p.wmu.Lock()
+	if interface{}(p.r) == interface{}(p.w) {
+		c := &recConn{rec: rec, r: p.r, w: p.w}
+		p.r, p.w = c, c
+	} else {
+		p.r = &recConn{rec: rec, r: p.r}
+		p.w = &recConn{rec: rec, w: p.w}
+	}
+	p.wmu.Unlock()
+	return rec
+}
+
+// 停止记录，之后的读写不再记录
+func (rec *Recorder) Stop() {
+	rec.mu.Lock()
+	rec.stop = true
+	rec.mu.Unlock()
+}
+
+// 返回写记录时的错误
+func (rec *Recorder) Err() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+func (rec *Recorder) record(dir Direction, b []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.stop || rec.err != nil {
+		return
+	}
+	h := rec.hdr[:]
+	h[0] = byte(dir)
+	putSeq(h[1:], uint64(time.Since(rec.start)))
+	n := len(b)
+	h[9], h[10], h[11], h[12] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+	if _, rec.err = rec.w.Write(h); rec.err == nil {
+		_, rec.err = rec.w.Write(b)
+	}
+}
+
+// 记录读写数据的 r 和 w，r 和 w 是同一个对象时共用一个 recConn。
+// 截止时间和 Close 交给原来的对象，不支持时返回 ErrNoDeadline。
+type recConn struct {
+	rec *Recorder
+	r   io.Reader
+	w   io.Writer
+}
+
+func (c *recConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.rec.record(DirRead, b[:n])
+	}
+	return n, err
+}
+
+func (c *recConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if n > 0 {
+		c.rec.record(DirWrite, b[:n])
+	}
+	return n, err
+}
+
+func (c *recConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.r.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return ErrNoDeadline
+}
+
+func (c *recConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return ErrNoDeadline
+}
+
+func (c *recConn) Close() error {
+	var x interface{} = c.r
+	if c.r == nil {
+		x = c.w
+	}
+	if cl, ok := x.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// 按记录的时间重放一个方向的数据。
+// 例如把读到的数据交给新的 Blk，重现当时收到的数据流:
+//
+//	rp, err := blk.NewReplayer(f, blk.DirRead, 10)
+//	p := blk.NewBlk(rp, ioutil.Discard)
+type Replayer struct {
+	r     io.Reader
+	dir   Direction
+	speed float64
+	base  time.Duration // 第一个记录的时间
+	start time.Time     // 第一个记录返回的时间
+	buf   []byte
+	data  []byte // 当前记录未读取的数据
+	err   error
+}
+
+// 从 r 读取记录，只重放 dir 方向的数据。
+// speed 是重放的速度，1 为原始速度，2 为两倍速度，小于等于 0 时不等待。
+func NewReplayer(r io.Reader, dir Direction, speed float64) (*Replayer, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrRecord
+		}
+		return nil, err
+	}
+	if string(h[:8]) != recMagic {
+		return nil, ErrRecord
+	}
+	return &Replayer{r: r, dir: dir, speed: speed}, nil
+}
+
+// 读取重放的数据，每个记录的数据在按速度换算的时间之前不会返回，
+// 第一个记录立即返回。记录结束时返回 io.EOF。
+func (rp *Replayer) Read(b []byte) (int, error) {
+	for len(rp.data) == 0 {
+		if rp.err != nil {
+			return 0, rp.err
+		}
+		rp.next()
+	}
+	n := copy(b, rp.data)
+	rp.data = rp.data[n:]
+	return n, nil
+}
+
+// 读取下一个 dir 方向的记录
+func (rp *Replayer) next() {
+	var h [13]byte
+	if _, err := io.ReadFull(rp.r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrRecord
+		}
+		rp.err = err
+		return
+	}
+	n := int(h[9])<<24 | int(h[10])<<16 | int(h[11])<<8 | int(h[12])
+	if n > recMaxData {
+		rp.err = ErrRecord
+		return
+	}
+	if cap(rp.buf) < n {
+		rp.buf = make([]byte, n)
+	}
+	data := rp.buf[:n]
+	if _, err := io.ReadFull(rp.r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrRecord
+		}
+		rp.err = err
+		return
+	}
+	if Direction(h[0]) != rp.dir {
+		return
+	}
+	rp.wait(time.Duration(getSeq(h[1:])))
+	rp.data = data
+}
+
+func (rp *Replayer) wait(t time.Duration) {
+	if rp.speed <= 0 {
+		return
+	}
+	if rp.start.IsZero() {
+		rp.base, rp.start = t, time.Now()
+		return
+	}
+	at := rp.start.Add(time.Duration(float64(t-rp.base) / rp.speed))
+	if d := time.Until(at); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,108 @@
+package blk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 重放的数据流中依次是 msg0 到 msg4，然后是 Close 信号
+func replayBlocks(t *testing.T, rp *Replayer) {
+	t.Helper()
+	p := NewBlk(rp, io.Discard)
+	for i := 0; i < 5; i++ {
+		r, err := p.NextBlock()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if m, _ := io.ReadAll(r); string(m) != fmt.Sprint("msg", i) {
+			t.Fatalf("%d %q", i, m)
+		}
+	}
+	if _, err := p.NextBlock(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	a, b := NewBlk(c1, c1), NewBlk(c2, c2)
+	var rec bytes.Buffer
+	r := a.Record(&rec)
+	go func() {
+		for i := 0; i < 5; i++ {
+			b.WriteBlock([]byte(fmt.Sprint("msg", i)))
+			time.Sleep(20 * time.Millisecond)
+		}
+		b.CloseWrite()
+	}()
+	echo := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, c2)
+		echo <- err
+	}()
+	buf := make([]byte, 100)
+	for i := 0; i < 5; i++ {
+		n, err := a.ReadBlock(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.WriteBlock(buf[:n])
+	}
+	if _, err := a.ReadBlock(buf); err != io.EOF {
+		t.Fatal(err)
+	}
+	a.CloseWrite()
+	r.Stop()
+	c1.Close()
+	<-echo
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	data := rec.Bytes()
+	el := map[float64]time.Duration{}
+	for _, speed := range []float64{0, 1, 4} {
+		rp, err := NewReplayer(bytes.NewReader(data), DirRead, speed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		replayBlocks(t, rp)
+		el[speed] = time.Since(start)
+	}
+	// 记录中 msg0 到 Close 信号之间至少 80ms
+	if el[1] < 80*time.Millisecond || el[4] < 20*time.Millisecond || el[0] >= el[4] || el[4] >= el[1] {
+		t.Fatal(el)
+	}
+	rp, err := NewReplayer(bytes.NewReader(data), DirWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayBlocks(t, rp)
+}
+
+func TestReplayInvalid(t *testing.T) {
+	var rec bytes.Buffer
+	p := NewBlk(bytes.NewReader(nil), io.Discard)
+	p.Record(&rec)
+	p.WriteBlock([]byte("hello"))
+	data := rec.Bytes()
+	if _, err := NewReplayer(bytes.NewReader(data[:5]), DirWrite, 0); err != ErrRecord {
+		t.Fatal(err)
+	}
+	rp, _ := NewReplayer(bytes.NewReader(data[:len(data)-1]), DirWrite, 0)
+	if _, err := io.ReadAll(rp); err != ErrRecord {
+		t.Fatal(err)
+	}
+	// 超过 recMaxData 的长度不分配内存
+	big := append([]byte{}, data[:16]...)
+	big = append(big, 'W', 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF)
+	rp, _ = NewReplayer(bytes.NewReader(big), DirWrite, 0)
+	if _, err := io.ReadAll(rp); err != ErrRecord {
+		t.Fatal(err)
+	}
+}
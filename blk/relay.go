@@ -0,0 +1,109 @@
+package blk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Relay 转发的 block 的默认最大字节数
+const DefaultRelayMaxBlock = 16 << 20
+
+var ErrBlockTooLarge = errors.New("blk: block too large") // error: block 超过 Relay 或 Session 的最大字节数
+
+// 在两个 Blk 之间按 block 转发。
+// 与 SetRaw 之后 io.Copy 不同，每个 block 被完整读出，交给 Filter 检查或改写后，
+// 按目标 Blk 自己的设置压缩、校验或加密后写出，两端可以使用不同的设置。
+// 心跳和属性声明不被转发，由两端的 Blk 各自处理，FOM 之后插入的 block 交给来源 Blk 的 OnMixin。
+// 被放弃的 block 和校验失败的 block 被丢弃，对端的 Close 信号转为另一端的 CloseWrite。
+//
+//	r := &blk.Relay{
+//		Filter: func(from, to *blk.Blk, b []byte) ([]byte, error) {
+//			return bytes.ReplaceAll(b, old, new), nil
+//		},
+//		HeartBeat: 10 * time.Second,
+//		Timeout:   30 * time.Second,
+//	}
+//	err := r.Run(client, upstream)
+type Relay struct {
+	// 转发前调用，返回写到 to 的数据，返回 nil 丢弃这个 block，返回错误时结束转发。
+	// 同一方向的 block 按顺序调用，两个方向可能同时调用。b 之后不再被使用，可以保留。
+	// Filter 可以直接写 from 来回应，或者写其他 Blk 来改变 block 的去向。
+	Filter func(from, to *Blk, b []byte) ([]byte, error)
+
+	// 单个 block 的最大字节数，超过时结束转发并返回 ErrBlockTooLarge，0 表示 DefaultRelayMaxBlock
+	MaxBlockSize int
+
+	// HeartBeat 大于 0 时两端各自以 KeepAlive(HeartBeat, Timeout, nil) 启用心跳，Run 返回时停止
+	HeartBeat, Timeout time.Duration
+}
+
+// 在 a 和 b 之间双向转发，Run 独占 a 和 b 的读取。
+// 两个方向都读到 Close 信号后返回 nil，一个方向出错时关闭两端的连接并返回这个错误。
+// 返回前关闭 a 和 b 的 r 和 w 中实现了 io.Closer 的对象。
+func (r *Relay) Run(a, b *Blk) error {
+	if r.HeartBeat > 0 {
+		a.KeepAlive(r.HeartBeat, r.Timeout, nil)
+		b.KeepAlive(r.HeartBeat, r.Timeout, nil)
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- r.forward(a, b) }()
+	go func() { errc <- r.forward(b, a) }()
+	err := <-errc
+	if err != nil {
+		a.closeConn()
+		b.closeConn()
+		<-errc
+	} else {
+		err = <-errc
+	}
+	a.KeepAlive(0, 0, nil)
+	b.KeepAlive(0, 0, nil)
+	a.closeConn()
+	b.closeConn()
+	return err
+}
+
+// 把 from 读到的 block 转发给 to，读到 Close 信号时 to.CloseWrite
+func (r *Relay) forward(from, to *Blk) error {
+	max := r.MaxBlockSize
+	if max <= 0 {
+		max = DefaultRelayMaxBlock
+	}
+	for {
+		rd, err := from.NextBlock()
+		if err == io.EOF {
+			return to.CloseWrite()
+		}
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(io.LimitReader(rd, int64(max)+1))
+		if _, ok := err.(*ChecksumError); ok || err == ErrBlockAborted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if buf.Len() > max {
+			return ErrBlockTooLarge
+		}
+		data := buf.Bytes()
+		if data == nil {
+			data = []byte{}
+		}
+		if r.Filter != nil {
+			if data, err = r.Filter(from, to, data); err != nil {
+				return err
+			}
+			if data == nil {
+				continue
+			}
+		}
+		if _, err = to.WriteBlock(data); err != nil {
+			return err
+		}
+	}
+}
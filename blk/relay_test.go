@@ -0,0 +1,149 @@
+package blk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// 启动转发 a 和 b 的 Relay，返回两端和 Run 的结果
+func relayPair(t *testing.T, r *Relay) (a, b *Blk, done chan error) {
+	a, ra := tcpPair(t)
+	b, rb := tcpPair(t)
+	done = make(chan error, 1)
+	go func() { done <- r.Run(ra, rb) }()
+	return a, b, done
+}
+
+func TestRelayFilter(t *testing.T) {
+	r := &Relay{Filter: func(from, to *Blk, b []byte) ([]byte, error) {
+		switch string(b) {
+		case "drop":
+			return nil, nil
+		case "ping":
+			_, err := from.WriteBlock([]byte("pong"))
+			return nil, err
+		}
+		return bytes.ToUpper(b), nil
+	}}
+	a, b, done := relayPair(t, r)
+	big := bytes.Repeat([]byte("x"), 200000)
+	go func() {
+		a.WriteBlock([]byte("hello"))
+		a.WriteBlock([]byte("drop"))
+		a.WriteBlock([]byte{})
+		a.WriteBlock(big)
+		a.WriteBlock([]byte("ping"))
+		a.CloseWrite()
+	}()
+	// 在另一个 goroutine 中读取 a，不能调用 t.Fatal
+	back := make(chan error, 1)
+	go func() {
+		for _, want := range []string{"pong", "BACK"} {
+			if want == "BACK" {
+				b.WriteBlock([]byte("back"))
+			}
+			r, err := a.NextBlock()
+			if err != nil {
+				back <- err
+				return
+			}
+			if m, _ := io.ReadAll(r); string(m) != want {
+				back <- errors.New("want " + want + ", got " + string(m))
+				return
+			}
+		}
+		b.CloseWrite()
+		_, err := a.NextBlock()
+		if err == io.EOF {
+			err = nil
+		}
+		back <- err
+	}()
+	for i, want := range [][]byte{[]byte("HELLO"), {}, bytes.ToUpper(big)} {
+		if got := readAll(t, b); !bytes.Equal(got, want) {
+			t.Fatal(i, len(got))
+		}
+	}
+	if _, err := b.NextBlock(); err != io.EOF {
+		t.Fatal(err)
+	}
+	if err := <-back; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayErrors(t *testing.T) {
+	bad := errors.New("bad")
+	r := &Relay{MaxBlockSize: 10, Filter: func(from, to *Blk, b []byte) ([]byte, error) {
+		if string(b) == "bad" {
+			return nil, bad
+		}
+		return b, nil
+	}}
+	a, _, done := relayPair(t, r)
+	go a.WriteBlock([]byte("bad"))
+	if err := <-done; err != bad {
+		t.Fatal(err)
+	}
+	a, _, done = relayPair(t, r)
+	go a.WriteBlock(make([]byte, 11))
+	if err := <-done; err != ErrBlockTooLarge {
+		t.Fatal(err)
+	}
+}
+
+// b 不发送心跳，转发端在 Timeout 后断开
+func TestRelayHeartBeat(t *testing.T) {
+	r := &Relay{HeartBeat: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	a, b, done := relayPair(t, r)
+	a.KeepAlive(20*time.Millisecond, 0, nil)
+	defer a.KeepAlive(0, 0, nil)
+	go func() {
+		for {
+			if _, err := b.NextBlock(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("want error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no timeout")
+	}
+	if s := b.Stats(); s.HeartBeatsIn == 0 {
+		t.Fatalf("%+v", s)
+	}
+}
+
+// 校验失败的 block 被丢弃，之后的 block 继续转发
+func TestRelayChecksum(t *testing.T) {
+	raw := checksummed(t, []byte("corrupt me"), []byte("fine"))
+	raw[bytes.Index(raw, []byte("corrupt"))] ^= 1
+	raw = append(raw, _CLOSE...)
+	b, rb := tcpPair(t)
+	ra := NewBlk(bytes.NewReader(raw), io.Discard)
+	done := make(chan error, 1)
+	go func() { done <- (&Relay{}).Run(ra, rb) }()
+	if got := readAll(t, b); string(got) != "fine" {
+		t.Fatalf("%q", got)
+	}
+	if _, err := b.NextBlock(); err != io.EOF {
+		t.Fatal(err)
+	}
+	b.CloseWrite()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ra.ChecksumErrors() != 1 {
+		t.Fatal(ra.ChecksumErrors())
+	}
+}
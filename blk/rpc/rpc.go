@@ -0,0 +1,346 @@
+// rpc 在 blk 之上实现请求/响应调用。
+// 每个消息是一个 block，连接两端是对等的，都可以注册处理函数和发起调用。
+// 消息格式
+//
+//	kind[1] id[8] data
+//	kind
+//		kindCall   data 为 len(method)[1] method payload
+//		kindReply  data 为 payload
+//		kindError  data 为 code[1] message
+//		kindCancel 没有 data，取消正在执行的调用
+//
+// id 由调用方分配，响应使用相同的 id。
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/achun/foo/blk"
+)
+
+const (
+	kindCall byte = iota
+	kindReply
+	kindError
+	kindCancel
+)
+
+const headSize = 9
+
+// 写出取消和响应的超时，对端不再读取时不会一直阻塞
+const (
+	cancelTimeout = time.Second
+	replyTimeout  = 30 * time.Second
+)
+
+// 默认的消息最大字节数
+const DefaultMaxMessageSize = 16 << 20
+
+// 远端错误代码
+const (
+	CodeHandler  = iota + 1 // 处理函数返回错误
+	CodeNotFound            // 没有注册的方法
+	CodePanic               // 处理函数 panic
+	CodeCanceled            // 调用被取消
+)
+
+var (
+	ErrClosed   = errors.New("rpc: connection closed")
+	ErrProtocol = errors.New("rpc: protocol error")
+	ErrMethod   = errors.New("rpc: method name too long")
+	ErrTooLarge = errors.New("rpc: message too large")
+)
+
+// 远端返回的错误
+type RemoteError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc: %s: %s (code %d)", e.Method, e.Message, e.Code)
+}
+
+// 处理函数，调用方取消或连接关闭时 ctx 被取消
+type Handler func(ctx context.Context, payload []byte) ([]byte, error)
+
+type result struct {
+	data []byte
+	err  error
+}
+
+// 在一个 Blk 上的 RPC 连接
+type Conn struct {
+	p        *blk.Blk
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[uint64]chan result
+	handlers map[string]Handler
+	running  map[uint64]context.CancelFunc
+	err      error
+	done     chan struct{}
+	ctx      context.Context //Conn 关闭时被取消，用于写出取消和响应
+	stop     context.CancelFunc
+	max      int64 //原子操作
+}
+
+// 在 p 上创建 Conn 并开始读取，Conn 独占 p 的读取。
+func NewConn(p *blk.Blk) *Conn {
+	c := &Conn{
+		p:        p,
+		pending:  map[uint64]chan result{},
+		handlers: map[string]Handler{},
+		running:  map[uint64]context.CancelFunc{},
+		done:     make(chan struct{}),
+		max:      DefaultMaxMessageSize,
+	}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	go c.readLoop()
+	return c
+}
+
+// 设置读取的消息的最大字节数，包括消息头，n 小于等于 0 时使用 DefaultMaxMessageSize。
+// 收到更大的消息时 Conn 以 ErrTooLarge 关闭。
+func (c *Conn) SetMaxMessageSize(n int) *Conn {
+	if n <= 0 {
+		n = DefaultMaxMessageSize
+	}
+	atomic.StoreInt64(&c.max, int64(n))
+	return c
+}
+
+// 注册处理函数，method 超过 255 字节时返回 ErrMethod
+func (c *Conn) Handle(method string, h Handler) error {
+	if len(method) > 255 {
+		return ErrMethod
+	}
+	c.mu.Lock()
+	c.handlers[method] = h
+	c.mu.Unlock()
+	return nil
+}
+
+// 调用远端方法，ctx 用于超时和取消，写出请求时 ctx 结束也会放弃调用。
+// ctx 结束后立即返回，取消消息在另一个 goroutine 中写出。
+// 远端返回错误时 error 为 *RemoteError。
+func (c *Conn) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	if len(method) > 255 {
+		return nil, ErrMethod
+	}
+	ch := make(chan result, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.seq++
+	id := c.seq
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	b := make([]byte, headSize+1+len(method)+len(payload))
+	b[headSize] = byte(len(method))
+	copy(b[headSize+1:], method)
+	copy(b[headSize+1+len(method):], payload)
+	if err := c.send(ctx, kindCall, id, b); err != nil {
+		c.forget(id)
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		if e, ok := r.err.(*RemoteError); ok {
+			e.Method = method
+		}
+		return r.data, r.err
+	case <-ctx.Done():
+		if c.forget(id) {
+			go c.sendTimeout(cancelTimeout, kindCancel, id, make([]byte, headSize))
+		}
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// 关闭 Conn，未完成的调用返回 ErrClosed，不关闭底层连接。
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.stop()
+	for id, cancel := range c.running {
+		cancel()
+		delete(c.running, id)
+	}
+}
+
+// 删除等待的调用，返回调用是否还在等待
+func (c *Conn) forget(id uint64) bool {
+	c.mu.Lock()
+	_, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	return ok
+}
+
+// 写出消息，b 的前 headSize 字节留给消息头，ctx 结束时放弃写入
+func (c *Conn) send(ctx context.Context, kind byte, id uint64, b []byte) error {
+	b[0] = kind
+	for i := 0; i < 8; i++ {
+		b[1+i] = byte(id >> uint(56-8*i))
+	}
+	_, err := c.p.WriteBlockContext(ctx, b)
+	return err
+}
+
+// 在 d 之内写出消息，Conn 关闭时放弃写入
+func (c *Conn) sendTimeout(d time.Duration, kind byte, id uint64, b []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, d)
+	defer cancel()
+	return c.send(ctx, kind, id, b)
+}
+
+func (c *Conn) readLoop() {
+	for {
+		r, err := c.p.NextBlock()
+		var b []byte
+		if err == nil {
+			max := atomic.LoadInt64(&c.max)
+			b, err = io.ReadAll(io.LimitReader(r, max+1))
+			if err == nil && int64(len(b)) > max {
+				err = ErrTooLarge
+			}
+		}
+		if err == nil && len(b) < headSize {
+			err = ErrProtocol
+		}
+		if err == nil {
+			err = c.dispatch(b)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) dispatch(b []byte) error {
+	var id uint64
+	for _, v := range b[1:headSize] {
+		id = id<<8 | uint64(v)
+	}
+	data := b[headSize:]
+	switch b[0] {
+	case kindCall:
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return ErrProtocol
+		}
+		n := 1 + int(data[0])
+		// 在读取的 goroutine 中登记，之后读到的取消才不会丢失
+		ctx, cancel := context.WithCancel(context.Background())
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			cancel()
+			return nil
+		}
+		h := c.handlers[string(data[1:n])]
+		c.running[id] = cancel
+		c.mu.Unlock()
+		go c.serve(ctx, cancel, id, h, data[n:])
+	case kindReply, kindError:
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch == nil {
+			// 已经超时或取消
+			return nil
+		}
+		if b[0] == kindReply {
+			ch <- result{data: data}
+		} else if len(data) == 0 {
+			return ErrProtocol
+		} else {
+			ch <- result{err: &RemoteError{Code: int(data[0]), Message: string(data[1:])}}
+		}
+	case kindCancel:
+		c.mu.Lock()
+		cancel := c.running[id]
+		c.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
+
+// 执行调用并写出响应，h 为 nil 表示没有注册的方法
+func (c *Conn) serve(ctx context.Context, cancel context.CancelFunc, id uint64, h Handler, payload []byte) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.running, id)
+		c.mu.Unlock()
+		cancel()
+	}()
+
+	var (
+		data []byte
+		err  error
+		code int
+	)
+	if h == nil {
+		code, err = CodeNotFound, errors.New("method not found")
+	} else {
+		data, code, err = call(ctx, h, payload)
+	}
+	if ctx.Err() != nil {
+		// 调用方已经放弃
+		return
+	}
+	if err != nil {
+		msg := err.Error()
+		b := make([]byte, headSize+1+len(msg))
+		b[headSize] = byte(code)
+		copy(b[headSize+1:], msg)
+		c.sendTimeout(replyTimeout, kindError, id, b)
+		return
+	}
+	b := make([]byte, headSize+len(data))
+	copy(b[headSize:], data)
+	c.sendTimeout(replyTimeout, kindReply, id, b)
+}
+
+// 执行处理函数，捕获 panic
+func call(ctx context.Context, h Handler, payload []byte) (data []byte, code int, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			data, code, err = nil, CodePanic, fmt.Errorf("panic: %v", e)
+		}
+	}()
+	data, err = h(ctx, payload)
+	if err == context.Canceled {
+		code = CodeCanceled
+	} else if err != nil {
+		code = CodeHandler
+	}
+	return
+}
@@ -0,0 +1,222 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achun/foo/blk"
+)
+
+func pair() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	return NewConn(blk.NewBlk(c1, c1)), NewConn(blk.NewBlk(c2, c2))
+}
+
+func TestCall(t *testing.T) {
+	a, b := pair()
+	defer a.Close()
+	defer b.Close()
+	b.Handle("echo", func(ctx context.Context, p []byte) ([]byte, error) { return p, nil })
+	b.Handle("fail", func(ctx context.Context, p []byte) ([]byte, error) { return nil, errors.New("boom") })
+	b.Handle("panic", func(ctx context.Context, p []byte) ([]byte, error) { panic("x") })
+	b.Handle("slow", func(ctx context.Context, p []byte) ([]byte, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return []byte("late"), nil
+		}
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := fmt.Sprint(i)
+			r, err := a.Call(context.Background(), "echo", []byte(s))
+			if err != nil || string(r) != s {
+				t.Error(err, string(r))
+			}
+		}(i)
+	}
+	wg.Wait()
+	_, err := a.Call(context.Background(), "fail", nil)
+	if e, ok := err.(*RemoteError); !ok || e.Code != CodeHandler || e.Message != "boom" || e.Method != "fail" {
+		t.Fatal(err)
+	}
+	_, err = a.Call(context.Background(), "panic", nil)
+	if e, ok := err.(*RemoteError); !ok || e.Code != CodePanic {
+		t.Fatal(err)
+	}
+	_, err = a.Call(context.Background(), "nope", nil)
+	if e, ok := err.(*RemoteError); !ok || e.Code != CodeNotFound {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = a.Call(ctx, "slow", nil)
+	if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Fatal(err)
+	}
+	r, err := a.Call(context.Background(), "echo", make([]byte, 100000))
+	if err != nil || len(r) != 100000 {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err = a.Call(context.Background(), "echo", nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+// 紧跟在调用之后的取消也要送达处理函数
+func TestCancelRace(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		c1, c2 := net.Pipe()
+		b := NewConn(blk.NewBlk(c2, c2))
+		canceled := make(chan bool, 1)
+		b.Handle("wait", func(ctx context.Context, p []byte) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				canceled <- true
+			case <-time.After(2 * time.Second):
+				canceled <- false
+			}
+			return nil, ctx.Err()
+		})
+		p := blk.NewBlk(c1, c1)
+		call := append([]byte{kindCall, 0, 0, 0, 0, 0, 0, 0, 1, 4}, "wait"...)
+		p.WriteBlock(call)
+		p.WriteBlock([]byte{kindCancel, 0, 0, 0, 0, 0, 0, 0, 1})
+		if !<-canceled {
+			t.Fatal(i, "cancel lost")
+		}
+		b.Close()
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// 对端不读取时，ctx 结束后 Call 返回
+func TestCallStalled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	a := NewConn(blk.NewBlk(c1, c1))
+	defer a.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Call(ctx, "echo", make([]byte, 100000))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call blocked")
+	}
+}
+
+// 在 d 之内返回 f 的错误
+func within(t *testing.T, d time.Duration, f func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatal("blocked")
+	}
+	return nil
+}
+
+// 对端读取请求后不再读取，取消和响应的写入不能卡住之后的调用
+func TestCallPeerStopsReading(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	a := NewConn(blk.NewBlk(c1, c1))
+	defer a.Close()
+	a.Handle("echo", func(ctx context.Context, p []byte) ([]byte, error) { return p, nil })
+	peer := blk.NewBlk(c2, c2)
+	got := make(chan string, 1)
+	go func() {
+		// 只读取一个请求
+		buf := make([]byte, 100)
+		n, _ := peer.ReadBlock(buf)
+		got <- string(buf[headSize+1 : n])
+	}()
+	call := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := a.Call(ctx, "wait", nil)
+		return err
+	}
+	if err := within(t, 500*time.Millisecond, call); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if m := <-got; m != "wait" {
+		t.Fatal(m)
+	}
+	// 取消的写入还在等待
+	if err := within(t, 500*time.Millisecond, call); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// 对端的请求的响应也写不出去
+	go peer.WriteBlock(append([]byte{kindCall, 0, 0, 0, 0, 0, 0, 0, 1, 4}, "echo"...))
+	time.Sleep(20 * time.Millisecond)
+	if err := within(t, 500*time.Millisecond, call); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestMethodTooLong(t *testing.T) {
+	a, b := pair()
+	defer a.Close()
+	defer b.Close()
+	long := strings.Repeat("m", 256)
+	h := func(ctx context.Context, p []byte) ([]byte, error) { return p, nil }
+	if err := b.Handle(long, h); err != ErrMethod {
+		t.Fatal(err)
+	}
+	if err := b.Handle(long[:255], h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Call(context.Background(), long, nil); err != ErrMethod {
+		t.Fatal(err)
+	}
+	if r, err := a.Call(context.Background(), long[:255], []byte("ok")); err != nil || string(r) != "ok" {
+		t.Fatal(err, string(r))
+	}
+}
+
+// 收到超过 SetMaxMessageSize 的消息时 Conn 关闭
+func TestMaxMessageSize(t *testing.T) {
+	a, b := pair()
+	defer a.Close()
+	defer b.Close()
+	b.SetMaxMessageSize(100)
+	b.Handle("echo", func(ctx context.Context, p []byte) ([]byte, error) { return p, nil })
+	// 消息头 9 字节，方法名 1+4 字节
+	if r, err := a.Call(context.Background(), "echo", make([]byte, 86)); err != nil || len(r) != 86 {
+		t.Fatal(err, len(r))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := a.Call(ctx, "echo", make([]byte, 87)); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := b.Call(context.Background(), "echo", nil); err != ErrTooLarge {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,347 @@
+package blk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrSealed  = errors.New("blk: sealed block verification failed")   // error: 认证失败，被截断或者没有加密
+	ErrReplay  = errors.New("blk: sealed chunk replayed or reordered") // error: 序号不连续
+	ErrSealKey = errors.New("blk: unknown seal key")                   // error: 没有对应的密钥
+)
+
+// 加密的 block 以带有 attrSeal 的属性字开始，之后是
+//
+//	keyID[1] sid[8]
+//
+// 每个 chunk 的数据是一个记录
+//
+//	flags[1] seq[8] ciphertext tag[16]
+//
+// sid 是发送端的随机会话 ID，实际使用的密钥是 HMAC-SHA256(key, "blk seal" sid)，
+// 因此同一个预共享密钥用于多个连接时 nonce 也不会重复。
+// seq 在发送端的整个生命周期内递增，接收端要求 seq 连续，以拒绝重放。
+// 每个 block 的最后一个记录带有 sealFinal 标志并且没有数据，用来认证 block 的结束。
+const (
+	sealFinal    = 1
+	sealHead     = 1 + 8
+	sealOverhead = sealHead + 16
+)
+
+type sealKey struct {
+	id   byte
+	key  []byte
+	send cipher.AEAD //使用本端 sid 派生
+	recv cipher.AEAD //使用对端 sid 派生
+	rsid [8]byte
+}
+
+type sealer struct {
+	mu   sync.Mutex
+	keys map[byte]*sealKey
+	cur  *sealKey //发送使用的密钥
+	sid  [8]byte
+
+	// 发送，受 Blk.wmu 保护
+	wkey *sealKey
+	wseq uint64
+	wbuf []byte
+
+	// 接收
+	rsid  [8]byte
+	rsidx bool //已经收到过对端的 sid
+	rkey  cipher.AEAD
+	rseq  uint64
+	rbuf  []byte
+	rlen  int  //正在读取的记录大小
+	rn    int  //已经读取的记录数据
+	final bool //收到了 block 的最后一个记录
+}
+
+// 添加 AES-GCM 加密密钥，key 的长度为 16，24 或 32。
+// 添加过密钥后连接的两个方向都必须加密，读到没有加密的 block 时返回 ErrSealed，
+// 认证失败返回 ErrSealed，重放返回 ErrReplay，这些错误之后 Blk 不能再读取。
+// 第一次添加的密钥同时用于发送，第一次调用应该在开始读写之前。
+// 更换密钥时先在两端添加新密钥，再用 UseSealKey 切换发送密钥，最后删除旧密钥。
+// 加密的 block 中间不能插入 FOM block。
+func (p *Blk) AddSealKey(id byte, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	p.wmu.Lock()
+	s := p.seal
+	if s == nil {
+		s = &sealer{keys: map[byte]*sealKey{}}
+		if _, err := rand.Read(s.sid[:]); err != nil {
+			p.wmu.Unlock()
+			return err
+		}
+		p.seal = s
+	}
+	p.wmu.Unlock()
+	k := &sealKey{id: id, key: append([]byte(nil), key...)}
+	k.send = deriveSeal(k.key, s.sid)
+	s.mu.Lock()
+	s.keys[id] = k
+	if s.cur == nil {
+		s.cur = k
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// 切换发送使用的密钥，从下一个 block 开始生效
+func (p *Blk) UseSealKey(id byte) error {
+	s := p.seal
+	if s == nil {
+		return ErrSealKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.keys[id]
+	if k == nil {
+		return ErrSealKey
+	}
+	s.cur = k
+	return nil
+}
+
+// 删除密钥，删除发送使用的密钥后写入返回 ErrSealKey
+func (p *Blk) RemoveSealKey(id byte) {
+	s := p.seal
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.cur == s.keys[id] {
+		s.cur = nil
+	}
+	delete(s.keys, id)
+	s.mu.Unlock()
+}
+
+func deriveSeal(key []byte, sid [8]byte) cipher.AEAD {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("blk seal"))
+	m.Write(sid[:])
+	c, _ := aes.NewCipher(m.Sum(nil)[:len(key)])
+	a, _ := cipher.NewGCM(c)
+	return a
+}
+
+func sealNonce(seq uint64) []byte {
+	return []byte{0, 0, 0, 0, byte(seq >> 56), byte(seq >> 48), byte(seq >> 40), byte(seq >> 32),
+		byte(seq >> 24), byte(seq >> 16), byte(seq >> 8), byte(seq)}
+}
+
+// block 开始时选择发送密钥，调用者需持有 Blk.wmu
+func (s *sealer) start() bool {
+	s.mu.Lock()
+	s.wkey = s.cur
+	s.mu.Unlock()
+	return s.wkey != nil
+}
+
+// 加密 b 为一个带 chunk 头的记录，调用者需持有 Blk.wmu
+func (s *sealer) record(b []byte, flags byte) []byte {
+	if s.wbuf == nil {
+		s.wbuf = make([]byte, 2+maxChunk)
+	}
+	w := s.wbuf
+	n := sealOverhead + len(b)
+	s.wseq++
+	seq := s.wseq
+	w[0], w[1], w[2] = byte(n>>8), byte(n), flags
+	copy(w[3:], sealNonce(seq)[4:])
+	out := s.wkey.send.Seal(w[2+sealHead:2+sealHead], sealNonce(seq), b, w[2:2+sealHead])
+	return w[:2+sealHead+len(out)]
+}
+
+// 写加密的 block，调用者需持有 wmu
+func (p *Blk) writeSealed(pre, b []byte, eob bool) (int, error) {
+	s := p.seal
+	if pre != nil {
+		if n, err := p.rawWrite(pre); err != nil {
+			return 0, p.sealTimeout(err, n != 0)
+		}
+		p.eventAttr(DirWrite, uint16(pre[2])<<8|uint16(pre[3]))
+	}
+	size := p.csz - sealOverhead
+	if size < 1 {
+		size = 1
+	}
+	cnt := 0
+	for cnt < len(b) {
+		n := len(b) - cnt
+		if n > size {
+			n = size
+		}
+		if k, err := p.rawWrite(s.record(b[cnt:cnt+n], 0)); err != nil {
+			if err == ErrTimeout {
+				if k == 0 {
+					s.wseq--
+				}
+				return 0, p.sealTimeout(err, true)
+			}
+			return cnt, err
+		}
+		cnt += n
+		atomic.AddUint64(&p.st.chunksOut, 1)
+		p.wsize += n + sealOverhead
+		p.event(EventChunk, DirWrite, n+sealOverhead)
+	}
+	if eob {
+		p.vec = append(p.vec[:0], s.record(nil, sealFinal), p.eob())
+		p.wmid, p.wcrc = false, 0
+		if k, err := p.rawWritev(p.vec); err != nil {
+			if err == ErrTimeout {
+				if k == 0 {
+					s.wseq--
+					p.wrest = append(p.wrest, _ABORT...)
+					atomic.AddUint64(&p.st.abortsOut, 1)
+					p.event(EventAbort, DirWrite, p.wsize)
+					return 0, err
+				}
+				// 补全最后的记录和 EOB
+				rest := append(append([]byte(nil), p.vec[0]...), p.vec[1]...)
+				p.wrest = rest[k:]
+			}
+			return cnt, err
+		}
+		p.wsize += len(p.vec[0]) - 2
+		atomic.AddUint64(&p.st.chunksOut, 1)
+		atomic.AddUint64(&p.st.blocksOut, 1)
+		observe(&p.st.sizesOut, p.wsize)
+		if p.obs != nil {
+			p.event(EventChunk, DirWrite, len(p.vec[0])-2)
+			if p.wsum {
+				p.eventAttr(DirWrite, attrSum)
+			}
+			p.event(EventEOB, DirWrite, p.wsize)
+		}
+		if p.wclose {
+			return cnt, p.shut()
+		}
+	}
+	return cnt, nil
+}
+
+// 加密 block 写超时，sent 表示 block 已经有数据写出，此时放弃 block，
+// 否则恢复到 block 开始之前的状态。调用者需持有 wmu
+func (p *Blk) sealTimeout(err error, sent bool) error {
+	if err != ErrTimeout {
+		return err
+	}
+	if sent {
+		p.wrest = append(p.wrest, _ABORT...)
+		atomic.AddUint64(&p.st.abortsOut, 1)
+		p.event(EventAbort, DirWrite, p.wsize)
+	}
+	p.wmid, p.wcrc = false, 0
+	return err
+}
+
+// 读到 attrSeal 属性字，开始接收加密的 block
+func (p *Blk) unsealStart() error {
+	s := p.seal
+	if s == nil {
+		return p.sealFail(ErrSealKey)
+	}
+	if err := p.fill(9); err != nil {
+		return err
+	}
+	id := p.buf[p.pos]
+	var sid [8]byte
+	copy(sid[:], p.buf[p.pos+1:p.pos+9])
+	p.pos += 9
+	s.mu.Lock()
+	k := s.keys[id]
+	s.mu.Unlock()
+	if k == nil {
+		return p.sealFail(ErrSealKey)
+	}
+	if !s.rsidx {
+		s.rsid, s.rsidx = sid, true
+	} else if s.rsid != sid {
+		return p.sealFail(ErrReplay)
+	}
+	if k.recv == nil || k.rsid != sid {
+		k.recv, k.rsid = deriveSeal(k.key, sid), sid
+	}
+	s.rkey, s.final = k.recv, false
+	p.rseal = true
+	return nil
+}
+
+// 读取并解密 rlen 大小的记录，读取超时后再次调用时继续读取
+func (p *Blk) unseal() error {
+	s := p.seal
+	n := s.rlen
+	if s.final || n < sealOverhead {
+		return p.sealFail(ErrSealed)
+	}
+	if s.rbuf == nil {
+		s.rbuf = make([]byte, maxChunk)
+	}
+	b := s.rbuf[:n]
+	m := copy(b[s.rn:], p.buf[p.pos:p.end])
+	p.pos += m
+	s.rn += m
+	for s.rn < n {
+		k, err := p.readraw(b[s.rn:])
+		s.rn += k
+		if err != nil && s.rn < n {
+			return err
+		}
+	}
+	s.rlen = 0
+	seq := uint64(0)
+	for _, c := range b[1:sealHead] {
+		seq = seq<<8 | uint64(c)
+	}
+	if seq != s.rseq+1 {
+		return p.sealFail(ErrReplay)
+	}
+	plain, err := s.rkey.Open(b[sealHead:sealHead], sealNonce(seq), b[sealHead:], b[:sealHead])
+	if err != nil {
+		return p.sealFail(ErrSealed)
+	}
+	s.rseq = seq
+	if b[0]&sealFinal != 0 {
+		if len(plain) != 0 {
+			return p.sealFail(ErrSealed)
+		}
+		s.final = true
+	}
+	p.plain, p.size = plain, len(plain)
+	return nil
+}
+
+// 读到 EOB，加密的 block 必须以 sealFinal 记录结束
+func (p *Blk) unsealEnd() error {
+	if !p.rseal || !p.seal.final {
+		return p.sealFail(ErrSealed)
+	}
+	p.rseal = false
+	return FOB
+}
+
+// 加密错误之后不再读取
+func (p *Blk) sealFail(err error) error {
+	atomic.AddUint64(&p.st.sealErrs, 1)
+	p.eventErr(DirRead, err)
+	p.rerr = err
+	p.pos, p.end, p.size = 0, 0, 0
+	p.rseal, p.plain = false, nil
+	if p.seal != nil {
+		p.seal.rlen = 0
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package blk
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	sealKey1 = bytes.Repeat([]byte{7}, 32)
+	sealKey2 = bytes.Repeat([]byte{9}, 16)
+)
+
+// 返回读取 raw 的 Blk，已经添加了 sealKey1
+func sealReader(t *testing.T, raw []byte) *Blk {
+	p := NewBlk(bytes.NewReader(raw), nil)
+	if err := p.AddSealKey(1, sealKey1); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSeal(t *testing.T) {
+	var wire bytes.Buffer
+	a := NewBlk(nil, &wire)
+	if err := a.AddSealKey(1, sealKey1); err != nil {
+		t.Fatal(err)
+	}
+	doc := bytes.Repeat([]byte("secret!!"), 30000)
+	a.WriteBlock([]byte("hello"))
+	a.WriteBlock(doc)
+	bw := a.NewBlockWriter()
+	bw.Write(doc)
+	bw.Close()
+	a.WriteBlock(nil)
+	a.AddSealKey(2, sealKey2)
+	a.UseSealKey(2)
+	a.WriteBlock([]byte("rotated"))
+	raw := wire.Bytes()
+	if bytes.Contains(raw, []byte("secret")) || bytes.Contains(raw, []byte("hello")) {
+		t.Fatal("plaintext on the wire")
+	}
+
+	b := sealReader(t, raw)
+	b.AddSealKey(2, sealKey2)
+	buf := make([]byte, 300000)
+	for i, want := range [][]byte{[]byte("hello"), doc, doc, nil, []byte("rotated")} {
+		n, err := b.ReadBlock(buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatal(i, n, err)
+		}
+	}
+
+	// 篡改
+	bad := append([]byte(nil), raw...)
+	bad[30] ^= 1
+	if _, err := sealReader(t, bad).ReadBlock(buf); err != ErrSealed {
+		t.Fatal(err)
+	}
+
+	// 重放第一个 block
+	i := bytes.Index(raw[4:], []byte{0xFF, 0xFF}) + 4 + 2
+	rep := append(append([]byte(nil), raw[:i]...), raw[:i]...)
+	b = sealReader(t, rep)
+	if _, err := b.ReadBlock(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReadBlock(buf); err != ErrReplay {
+		t.Fatal(err)
+	}
+
+	// 没有密钥
+	if _, err := NewBlk(bytes.NewReader(raw), nil).ReadBlock(buf); err != ErrSealKey {
+		t.Fatal(err)
+	}
+
+	// 没有加密
+	var plain bytes.Buffer
+	NewBlk(nil, &plain).WriteBlock([]byte("x"))
+	if _, err := sealReader(t, plain.Bytes()).ReadBlock(buf); err != ErrSealed {
+		t.Fatal(err)
+	}
+}
+
+// 加密同时压缩和校验
+func TestSealHandshake(t *testing.T) {
+	doc := testDoc(200000)
+	a, b := tcpPair(t)
+	a.AddSealKey(5, sealKey2)
+	b.AddSealKey(5, sealKey2)
+	handshake(t, a, b, Hello{Checksum: true, Compress: CompressFlate}, Hello{Compress: CompressGzip})
+	go func() {
+		a.WriteBlock(doc)
+		bw := a.NewBlockWriter()
+		bw.Write(doc)
+		bw.Close()
+		a.WriteBlock([]byte("small"))
+	}()
+	for i, want := range [][]byte{doc, doc, []byte("small")} {
+		if got := readAll(t, b); !bytes.Equal(got, want) {
+			t.Fatal(i, len(got))
+		}
+	}
+	if s := b.Stats(); s.BytesIn > uint64(len(doc)) || s.ChecksumErrors != 0 {
+		t.Fatalf("%+v", s)
+	}
+}
@@ -0,0 +1,188 @@
+package blk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("blk: server closed") // error: Serve 在 Shutdown 或 Close 之后返回
+
+// 连接服务
+//
+//	s := &blk.Server{Handler: func(conn net.Conn, p *blk.Blk) { ... }}
+//	go s.Serve(l)
+//	...
+//	s.Shutdown(ctx)
+type Server struct {
+	// 处理连接，返回后连接被关闭。
+	// 读到 io.EOF 表示对端发送了 Close 信号，应该结束处理。
+	Handler func(conn net.Conn, p *Blk)
+
+	// 同时处理的最大连接数，达到时暂停 Accept，0 表示不限制
+	MaxConns int
+
+	// 连接建立后，调用 Handler 之前调用，可以用来设置 Blk
+	OnOpen func(conn net.Conn, p *Blk)
+
+	// 连接关闭后调用，Handler panic 时 err 不为 nil
+	OnClose func(conn net.Conn, err error)
+
+	// 不为 nil 时以对端地址为名称登记每个连接，连接关闭后移除
+	Registry *Registry
+
+	mu      sync.Mutex
+	lns     map[net.Listener]struct{}
+	conns   map[net.Conn]*Blk
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	closing bool
+}
+
+// 在 l 上接受连接，每个连接在单独的 goroutine 中处理。
+// Shutdown 或 Close 之后返回 ErrServerClosed。
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.lns == nil {
+		s.lns = map[net.Listener]struct{}{}
+		s.conns = map[net.Conn]*Blk{}
+		if s.MaxConns > 0 {
+			s.sem = make(chan struct{}, s.MaxConns)
+		}
+	}
+	s.lns[l] = struct{}{}
+	sem := s.sem
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lns, l)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			if sem != nil {
+				<-sem
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// 暂时的错误，例如文件描述符用尽
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		p := NewBlk(conn, conn)
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = p
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn, p, sem)
+	}
+}
+
+func (s *Server) serve(conn net.Conn, p *Blk, sem chan struct{}) {
+	var err error
+	if s.Registry != nil {
+		s.Registry.Add(conn.RemoteAddr().String(), p)
+	}
+	defer func() {
+		conn.Close()
+		if s.Registry != nil {
+			s.Registry.Remove(p)
+		}
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		if s.OnClose != nil {
+			s.OnClose(conn, err)
+		}
+		if sem != nil {
+			<-sem
+		}
+		s.wg.Done()
+	}()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("blk: handler panic: %v", e)
+		}
+	}()
+	if s.OnOpen != nil {
+		s.OnOpen(conn, p)
+	}
+	s.Handler(conn, p)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// 停止接受连接，向所有连接发送 Close 信号，等待 Handler 处理完正在传送的 block 后返回。
+// 连接上正在发送的 block 结束后才发送 Close 信号。
+// ctx 结束时关闭剩余的连接并返回 ctx.Err()，不再等待 Handler 返回。
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.lns {
+		l.Close()
+	}
+	for _, p := range s.conns {
+		go p.CloseWrite()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.Close()
+	return ctx.Err()
+}
+
+// 立即停止接受连接并关闭所有连接
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	for l := range s.lns {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
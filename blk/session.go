@@ -0,0 +1,686 @@
+package blk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionLost   = errors.New("blk: session lost")   // error: 对端不再保留会话或者等待重连超时
+	ErrSessionClosed = errors.New("blk: session closed") // error: 会话已经关闭
+)
+
+// 可恢复的会话在 Blk 连接之上传送 block。
+// 连接断开后客户端按指数退避重新连接，两端交换已经收到的 block 数，
+// 重发对端没有收到的 block，应用看到的 block 流不会因为连接断开而中断。
+// 会话中每个 block 以类型开始
+//
+//	sessHello flags[1] id[8] rseq[8]  连接建立后首先交换，rseq 是已经收到的 block 数
+//	sessData  seq[8] data             数据，seq 从 1 开始
+//	sessAck   rseq[8]                 确认收到的 block
+//	sessClose                         关闭会话
+const (
+	sessHello = iota
+	sessData
+	sessAck
+	sessClose
+)
+
+// sessHello 的 flags
+const (
+	helloNew    = 1 // 客户端开始新的会话
+	helloReject = 2 // 服务端没有这个会话
+)
+
+const (
+	sessWindow   = 256              // 未确认 block 的最大数量
+	sessAckEvery = 32               // 每收到这么多 block 确认一次
+	helloTimeout = 10 * time.Second // 交换 sessHello 的超时
+
+	DefaultSessionLinger   = time.Minute // 服务端在连接断开后保留会话的时间
+	DefaultSessionMaxBlock = 16 << 20    // 收到的 block 的最大字节数
+)
+
+// 可恢复的会话
+type Session struct {
+	rseq    uint64 //已经收到的 block 数，原子操作
+	id      [8]byte
+	dial    func() (net.Conn, error) //客户端重连
+	setup   func(*Blk) error
+	bmin    time.Duration
+	bmax    time.Duration
+	owner   *Sessions //服务端
+	dialing bool
+	max     int64 //收到的 block 的最大字节数，原子操作
+
+	wmu    sync.Mutex //串行化发送和重发
+	mu     sync.Mutex
+	cond   *sync.Cond
+	conn   net.Conn //当前连接，nil 表示已断开
+	p      *Blk
+	wseq   uint64   //已经发送的 block 数
+	unack  [][]byte //没有确认的 block，最后一个的序号是 wseq
+	err    error
+	done   chan struct{}
+	linger *time.Timer
+
+	rmu    sync.Mutex //串行化递交收到的 block
+	racked uint64
+	acks   chan struct{} //通知 ackLoop 发送确认
+	in     chan []byte   //收到的 block，nil 表示对端关闭了会话
+	rest   []byte        //ReadBlock 没有读完的 block
+	eof    bool
+}
+
+func newSession() *Session {
+	s := &Session{
+		done: make(chan struct{}),
+		acks: make(chan struct{}, 1),
+		in:   make(chan []byte, sessWindow),
+		max:  DefaultSessionMaxBlock,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// 用 dial 建立连接并开始新的会话，连接断开后会重新调用 dial。
+// setup 不为 nil 时，每个新连接在交换会话信息之前调用，例如用来握手或启用心跳，
+// 返回错误时放弃这个连接。
+// 第一次连接失败时返回错误。之后的重连一直持续到会话被关闭，
+// 服务端不再保留会话时读写返回 ErrSessionLost。
+func DialSession(dial func() (net.Conn, error), setup func(p *Blk) error) (*Session, error) {
+	s := newSession()
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil, err
+	}
+	s.dial, s.setup = dial, setup
+	s.bmin, s.bmax = 100*time.Millisecond, 30*time.Second
+	conn, err := dial()
+	if err == nil {
+		err = s.link(conn, helloNew)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 设置重连的退避时间，从 min 开始每次加倍直到 max
+func (s *Session) SetBackoff(min, max time.Duration) *Session {
+	s.mu.Lock()
+	s.bmin, s.bmax = min, max
+	s.mu.Unlock()
+	return s
+}
+
+// 设置收到的 block 的最大字节数，n 小于等于 0 时使用 DefaultSessionMaxBlock。
+// 收到更大的 block 时会话以 ErrBlockTooLarge 结束。
+func (s *Session) SetMaxBlockSize(n int) *Session {
+	if n <= 0 {
+		n = DefaultSessionMaxBlock
+	}
+	atomic.StoreInt64(&s.max, int64(n))
+	return s
+}
+
+// 写一个 block。
+// 连接断开时 block 被保留，重连后发送。没有确认的 block 达到上限时等待对端确认。
+func (s *Session) WriteBlock(b []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.unack) >= sessWindow && s.err == nil {
+		s.cond.Wait()
+	}
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	f := make([]byte, 9+len(b))
+	f[0] = sessData
+	copy(f[9:], b)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return 0, s.err
+	}
+	s.wseq++
+	putSeq(f[1:], s.wseq)
+	s.unack = append(s.unack, f)
+	conn, p := s.conn, s.p
+	s.mu.Unlock()
+	if p != nil {
+		if _, err := p.WriteBlock(f); err != nil {
+			s.broken(conn)
+		}
+	}
+	return len(b), nil
+}
+
+// 读取一个 block，b 不够大时返回 ETE，之后的调用继续读取这个 block。
+// 对端关闭会话后返回 io.EOF。
+func (s *Session) ReadBlock(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, EOE
+	}
+	if s.rest == nil {
+		d, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		s.rest = d
+	}
+	n := copy(b, s.rest)
+	s.rest = s.rest[n:]
+	if len(s.rest) != 0 {
+		return n, ETE
+	}
+	s.rest = nil
+	return n, nil
+}
+
+// 返回下一个 block 的 Reader，丢弃当前 block 没有读取的部分
+func (s *Session) NextBlock() (io.Reader, error) {
+	s.rest = nil
+	d, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(d), nil
+}
+
+func (s *Session) next() ([]byte, error) {
+	if s.eof {
+		return nil, io.EOF
+	}
+	var d []byte
+	select {
+	case d = <-s.in:
+	case <-s.done:
+		// 先读完已经收到的 block
+		select {
+		case d = <-s.in:
+		default:
+			return nil, s.err
+		}
+	}
+	if d == nil {
+		s.eof = true
+		return nil, io.EOF
+	}
+	return d, nil
+}
+
+// 关闭会话并通知对端，连接断开时对端不会收到通知。
+func (s *Session) Close() error {
+	s.wmu.Lock()
+	s.mu.Lock()
+	p := s.p
+	s.mu.Unlock()
+	if p != nil {
+		p.WriteBlock([]byte{sessClose})
+	}
+	s.wmu.Unlock()
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// 结束会话
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	close(s.done)
+	conn := s.conn
+	s.conn, s.p = nil, nil
+	if s.linger != nil {
+		s.linger.Stop()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if s.owner != nil {
+		s.owner.remove(s)
+	}
+}
+
+// 客户端建立连接
+func (s *Session) link(conn net.Conn, flags byte) error {
+	p := NewBlk(conn, conn)
+	if s.setup != nil {
+		if err := s.setup(p); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	conn.SetDeadline(time.Now().Add(helloTimeout))
+	err := writeHello(p, flags, s.id, atomic.LoadUint64(&s.rseq))
+	var (
+		id [8]byte
+		r  uint64
+	)
+	if err == nil {
+		flags, id, r, err = readHello(p)
+	}
+	if err == nil && (flags&helloReject != 0 || id != s.id) {
+		err = ErrSessionLost
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if err = s.install(conn, p, r); err != nil {
+		return err
+	}
+	go s.readLoop(conn, p)
+	return nil
+}
+
+// 使用新的连接，r 是对端已经收到的 block 数，重发对端没有收到的 block
+func (s *Session) install(conn net.Conn, p *Blk, r uint64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	err := s.err
+	if err == nil {
+		err = s.ack(r)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		conn.Close()
+		s.fail(err)
+		return err
+	}
+	old := s.conn
+	s.conn, s.p = conn, p
+	s.dialing = false
+	if s.linger != nil {
+		s.linger.Stop()
+		s.linger = nil
+	}
+	resend := append([][]byte(nil), s.unack...)
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	for _, f := range resend {
+		if _, err := p.WriteBlock(f); err != nil {
+			s.broken(conn)
+			break
+		}
+	}
+	return nil
+}
+
+// 对端已经收到 r 个 block，丢弃已确认的 block，调用者需持有 mu
+func (s *Session) ack(r uint64) error {
+	if r > s.wseq {
+		return ErrProtocol
+	}
+	base := s.wseq - uint64(len(s.unack))
+	if r <= base {
+		return nil
+	}
+	n := copy(s.unack, s.unack[r-base:])
+	for i := n; i < len(s.unack); i++ {
+		s.unack[i] = nil
+	}
+	s.unack = s.unack[:n]
+	s.cond.Broadcast()
+	return nil
+}
+
+// 连接断开，客户端开始重连，服务端等待客户端重连
+func (s *Session) broken(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	s.conn, s.p = nil, nil
+	conn.Close()
+	s.relink()
+}
+
+// 调用者需持有 mu
+func (s *Session) relink() {
+	if s.err != nil {
+		return
+	}
+	if s.dial != nil {
+		if !s.dialing {
+			s.dialing = true
+			go s.redial()
+		}
+	} else if s.owner != nil && s.linger == nil {
+		s.linger = time.AfterFunc(s.owner.linger(), func() {
+			s.mu.Lock()
+			lost := s.conn == nil
+			s.mu.Unlock()
+			if lost {
+				s.fail(ErrSessionLost)
+			}
+		})
+	}
+}
+
+func (s *Session) redial() {
+	s.mu.Lock()
+	d, max := s.bmin, s.bmax
+	s.mu.Unlock()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(d):
+		}
+		conn, err := s.dial()
+		if err == nil {
+			err = s.link(conn, 0)
+		}
+		if err == nil {
+			return
+		}
+		if err == ErrSessionLost || err == ErrProtocol {
+			s.fail(err)
+			return
+		}
+		if d *= 2; d > max {
+			d = max
+		}
+	}
+}
+
+func (s *Session) readLoop(conn net.Conn, p *Blk) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.ackLoop(stop)
+	for {
+		r, err := p.NextBlock()
+		var b []byte
+		if err == nil {
+			// 加上 sessData 的 9 字节
+			max := atomic.LoadInt64(&s.max) + 9
+			b, err = io.ReadAll(io.LimitReader(r, max+1))
+			if err == nil && int64(len(b)) > max {
+				err = ErrBlockTooLarge
+			}
+		}
+		if err == nil {
+			err = s.handle(b)
+		}
+		if err == ErrProtocol || err == ErrBlockTooLarge {
+			s.fail(err)
+			return
+		}
+		if err != nil {
+			s.broken(conn)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(b []byte) error {
+	if len(b) == 0 {
+		return ErrProtocol
+	}
+	switch b[0] {
+	case sessData:
+		if len(b) < 9 {
+			return ErrProtocol
+		}
+		return s.deliver(getSeq(b[1:]), b[9:])
+	case sessAck:
+		if len(b) < 9 {
+			return ErrProtocol
+		}
+		s.mu.Lock()
+		err := s.ack(getSeq(b[1:]))
+		s.mu.Unlock()
+		return err
+	case sessClose:
+		select {
+		case s.in <- nil:
+		case <-s.done:
+		}
+		s.fail(ErrSessionClosed)
+		return ErrSessionClosed
+	}
+	return ErrProtocol
+}
+
+// 递交收到的 block，丢弃重发的 block。
+// 替换连接时新旧连接的 readLoop 可能同时运行，rmu 保证每个 block 只递交一次。
+// 确认由 ackLoop 发送，应用的 WriteBlock 阻塞时 readLoop 仍然继续读取。
+func (s *Session) deliver(seq uint64, data []byte) error {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	r := atomic.LoadUint64(&s.rseq)
+	if seq <= r {
+		return nil
+	}
+	if seq != r+1 {
+		return ErrProtocol
+	}
+	select {
+	case s.in <- data:
+	case <-s.done:
+		return s.err
+	}
+	atomic.StoreUint64(&s.rseq, seq)
+	if seq-s.racked >= sessAckEvery {
+		s.racked = seq
+		select {
+		case s.acks <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// 在当前连接上发送确认，直到 stop 被关闭。
+// 确认的是发送时已经收到的 block 数，没来得及发送的确认合并成一个。
+func (s *Session) ackLoop(stop chan struct{}) {
+	for {
+		select {
+		case <-s.acks:
+		case <-stop:
+			return
+		}
+		s.mu.Lock()
+		conn, p := s.conn, s.p
+		s.mu.Unlock()
+		if p == nil {
+			// 重连时交换的 sessHello 带有已经收到的 block 数
+			continue
+		}
+		f := make([]byte, 9)
+		f[0] = sessAck
+		putSeq(f[1:], atomic.LoadUint64(&s.rseq))
+		if _, err := p.WriteBlock(f); err != nil {
+			s.broken(conn)
+		}
+	}
+}
+
+// 服务端的会话管理
+//
+//	m := blk.NewSessions()
+//	s := &blk.Server{Handler: m.Serve}
+//	go s.Serve(l)
+//	for {
+//		sess, err := m.Accept()
+//		...
+//	}
+type Sessions struct {
+	// 每个新连接在交换会话信息之前调用，返回错误时放弃这个连接
+	Setup func(p *Blk) error
+
+	// 连接断开后保留会话的时间，0 表示 DefaultSessionLinger
+	Linger time.Duration
+
+	// 新会话收到的 block 的最大字节数，0 表示 DefaultSessionMaxBlock
+	MaxBlockSize int
+
+	mu     sync.Mutex
+	m      map[[8]byte]*Session
+	accept chan *Session
+	done   chan struct{}
+	closed bool
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{
+		m:      map[[8]byte]*Session{},
+		accept: make(chan *Session, 64),
+		done:   make(chan struct{}),
+	}
+}
+
+// 处理一个连接，新的会话由 Accept 返回，已有的会话恢复使用这个连接。
+// 连接断开后返回，可以直接用作 Server.Handler。
+func (m *Sessions) Serve(conn net.Conn, p *Blk) {
+	if m.Setup != nil && m.Setup(p) != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(helloTimeout))
+	flags, id, r, err := readHello(p)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	s := m.m[id]
+	if flags&helloNew != 0 {
+		s = nil
+		if _, ok := m.m[id]; !ok && !m.closed {
+			s = newSession()
+			s.id, s.owner = id, m
+			s.SetMaxBlockSize(m.MaxBlockSize)
+			select {
+			case m.accept <- s:
+				m.m[id] = s
+			default:
+				s = nil
+			}
+		}
+	}
+	m.mu.Unlock()
+	if s == nil {
+		writeHello(p, helloReject, id, 0)
+		return
+	}
+	if writeHello(p, 0, id, atomic.LoadUint64(&s.rseq)) != nil {
+		// 新会话等待客户端重连
+		s.mu.Lock()
+		if s.conn == nil {
+			s.relink()
+		}
+		s.mu.Unlock()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if s.install(conn, p, r) != nil {
+		return
+	}
+	s.readLoop(conn, p)
+}
+
+// 返回下一个新的会话
+func (m *Sessions) Accept() (*Session, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// 关闭所有会话，之后 Accept 返回 ErrSessionClosed
+func (m *Sessions) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	all := make([]*Session, 0, len(m.m))
+	for _, s := range m.m {
+		all = append(all, s)
+	}
+	m.mu.Unlock()
+	for _, s := range all {
+		s.Close()
+	}
+	return nil
+}
+
+func (m *Sessions) remove(s *Session) {
+	m.mu.Lock()
+	if m.m[s.id] == s {
+		delete(m.m, s.id)
+	}
+	m.mu.Unlock()
+}
+
+func (m *Sessions) linger() time.Duration {
+	if m.Linger <= 0 {
+		return DefaultSessionLinger
+	}
+	return m.Linger
+}
+
+func writeHello(p *Blk, flags byte, id [8]byte, r uint64) error {
+	b := make([]byte, 18)
+	b[0], b[1] = sessHello, flags
+	copy(b[2:], id[:])
+	putSeq(b[10:], r)
+	_, err := p.WriteBlock(b)
+	return err
+}
+
+func readHello(p *Blk) (flags byte, id [8]byte, r uint64, err error) {
+	b := make([]byte, 32)
+	n, err := p.ReadBlock(b)
+	if err == nil && (n < 18 || b[0] != sessHello) {
+		err = ErrProtocol
+	}
+	if err == ETE {
+		err = ErrProtocol
+	}
+	if err != nil {
+		return
+	}
+	flags = b[1]
+	copy(id[:], b[2:10])
+	r = getSeq(b[10:])
+	return
+}
+
+func putSeq(b []byte, n uint64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(n >> uint(56-8*i))
+	}
+}
+
+func getSeq(b []byte) uint64 {
+	var n uint64
+	for _, c := range b[:8] {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
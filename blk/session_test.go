@@ -0,0 +1,192 @@
+package blk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 本地的会话服务，返回的 dial 记录建立的每个连接
+type sessTest struct {
+	m     *Sessions
+	mu    sync.Mutex
+	conns []net.Conn
+	dial  func() (net.Conn, error)
+}
+
+func newSessTest(t *testing.T) *sessTest {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &sessTest{m: NewSessions()}
+	st.m.Linger = time.Second
+	srv := &Server{Handler: st.m.Serve}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+		st.m.Close()
+	})
+	st.dial = func() (net.Conn, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			st.mu.Lock()
+			st.conns = append(st.conns, c)
+			st.mu.Unlock()
+		}
+		return c, err
+	}
+	return st
+}
+
+// 断开客户端当前的连接，返回建立过的连接数
+func (st *sessTest) cut() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.conns[len(st.conns)-1].Close()
+	return len(st.conns)
+}
+
+// 建立会话，返回客户端和服务端的 Session
+func (st *sessTest) pair(t *testing.T) (cs, ss *Session) {
+	cs, err := DialSession(st.dial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.SetBackoff(10*time.Millisecond, 100*time.Millisecond)
+	if ss, err = st.m.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return cs, ss
+}
+
+func TestSessionReconnect(t *testing.T) {
+	st := newSessTest(t)
+	cs, ss := st.pair(t)
+	const N = 2000
+	echo := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, err := ss.ReadBlock(buf)
+			if err != nil {
+				echo <- err
+				return
+			}
+			ss.WriteBlock(buf[:n])
+		}
+	}()
+	go func() {
+		for i := 0; i < N; i++ {
+			if _, err := cs.WriteBlock([]byte(fmt.Sprint(i))); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%300 == 150 {
+				st.cut()
+			}
+		}
+	}()
+	buf := make([]byte, 100)
+	for i := 0; i < N; i++ {
+		n, err := cs.ReadBlock(buf)
+		if err != nil || string(buf[:n]) != fmt.Sprint(i) {
+			t.Fatal(i, string(buf[:n]), err)
+		}
+	}
+	st.mu.Lock()
+	n := len(st.conns)
+	st.mu.Unlock()
+	if n < 5 {
+		t.Fatal("reconnects", n)
+	}
+	cs.Close()
+	if err := <-echo; err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := cs.WriteBlock(buf); err != ErrSessionClosed {
+		t.Fatal(err)
+	}
+}
+
+// 服务端不再保留会话时客户端读到 ErrSessionLost
+func TestSessionLost(t *testing.T) {
+	st := newSessTest(t)
+	cs, ss := st.pair(t)
+	cs.SetBackoff(10*time.Millisecond, 10*time.Millisecond)
+	ss.fail(ErrSessionLost)
+	time.Sleep(20 * time.Millisecond)
+	st.cut()
+	if _, err := cs.ReadBlock(make([]byte, 10)); err != ErrSessionLost {
+		t.Fatal(err)
+	}
+}
+
+// 两端同时发送大量数据，确认不能被阻塞的写卡住
+func TestSessionBulk(t *testing.T) {
+	st := newSessTest(t)
+	cs, ss := st.pair(t)
+	const N = 400
+	d := bytes.Repeat([]byte{'x'}, 1<<18)
+	var wg sync.WaitGroup
+	for _, s := range []*Session{cs, ss} {
+		s := s
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < N; i++ {
+				if _, err := s.WriteBlock(d); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < N; i++ {
+				r, err := s.NextBlock()
+				if err != nil {
+					t.Error(i, err)
+					return
+				}
+				if n, _ := io.Copy(io.Discard, r); n != int64(len(d)) {
+					t.Error(i, n)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("stalled")
+	}
+}
+
+// 收到超过 SetMaxBlockSize 的 block 时会话结束
+func TestSessionMaxBlockSize(t *testing.T) {
+	st := newSessTest(t)
+	cs, ss := st.pair(t)
+	ss.SetMaxBlockSize(100)
+	buf := make([]byte, 200)
+	cs.WriteBlock(buf[:100])
+	if n, err := ss.ReadBlock(buf); err != nil || n != 100 {
+		t.Fatal(n, err)
+	}
+	cs.WriteBlock(buf[:101])
+	if _, err := ss.ReadBlock(buf); err != ErrBlockTooLarge {
+		t.Fatal(err)
+	}
+	if _, err := cs.ReadBlock(buf); err != ErrSessionLost {
+		t.Fatal(err)
+	}
+}
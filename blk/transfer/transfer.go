@@ -0,0 +1,558 @@
+// transfer 在 blk 之上传送文件，连接断开后可以从接收端确认过的位置续传。
+// 每个消息是一个 block
+//
+//	kind[1] data
+//	kind
+//		kindMeta   发送端开始传送，data 为 size[8] sha256[32] window[8] name
+//		kindResume 接收端回应，data 为 offset[8]，发送端从 offset 开始发送
+//		kindData   data 为 offset[8] 文件数据
+//		kindAck    接收端已经保存到磁盘的数据，data 为 offset[8]，
+//		           接收端至少在收到 window 的一半数据时确认一次
+//		kindEnd    发送端的数据发送完毕
+//		kindDone   接收端校验 SHA-256 通过，文件保存完毕
+//		kindError  data 为错误信息，之后本次传送结束
+//
+// 接收端把数据写到 name.part，进度保存在 name.part.state 中，
+// 同一个文件(大小和 SHA-256 相同)再次传送时从保存的进度继续，校验通过后改名为 name。
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/achun/foo/blk"
+)
+
+const (
+	kindMeta byte = iota
+	kindResume
+	kindData
+	kindAck
+	kindEnd
+	kindDone
+	kindError
+)
+
+const (
+	DefaultBlockSize = 32 << 10 // 每个数据 block 的文件数据大小
+	DefaultWindow    = 4 << 20  // 发送端未确认数据的上限
+	DefaultAckEvery  = 1 << 20  // 接收端确认的间隔
+	DefaultRetries   = 5        // 没有进展时连续重新连接的次数
+)
+
+var (
+	ErrProtocol = errors.New("transfer: protocol error")
+	ErrHash     = errors.New("transfer: sha256 mismatch") // error: 接收到的文件校验失败，接收端删除了已接收的数据
+	ErrName     = errors.New("transfer: invalid file name")
+)
+
+// 对端返回的错误
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "transfer: remote: " + e.Message
+}
+
+// 对端的错误信息转换为 error，本包定义的错误返回原来的值
+func remoteError(msg []byte) error {
+	for _, err := range []error{ErrHash, ErrName, ErrProtocol} {
+		if string(msg) == err.Error() {
+			return err
+		}
+	}
+	return &RemoteError{string(msg)}
+}
+
+// 文件信息
+type meta struct {
+	size   int64
+	hash   [32]byte
+	window int64 //发送端未确认数据的上限
+	name   string
+}
+
+const metaSize = 1 + 8 + 32 + 8
+
+func (m *meta) encode() []byte {
+	b := make([]byte, metaSize+len(m.name))
+	b[0] = kindMeta
+	putOffset(b[1:], m.size)
+	copy(b[9:], m.hash[:])
+	putOffset(b[41:], m.window)
+	copy(b[metaSize:], m.name)
+	return b
+}
+
+func putOffset(b []byte, n int64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(n >> uint(56-8*i))
+	}
+}
+
+func getOffset(b []byte) int64 {
+	var n int64
+	for i := 0; i < 8; i++ {
+		n = n<<8 | int64(b[i])
+	}
+	return n
+}
+
+func message(kind byte, off int64) []byte {
+	b := make([]byte, 9)
+	b[0] = kind
+	putOffset(b[1:], off)
+	return b
+}
+
+func errorMessage(err error) []byte {
+	return append([]byte{kindError}, err.Error()...)
+}
+
+// 读取一个完整的 block
+func readBlock(p *blk.Blk, buf *bytes.Buffer) ([]byte, error) {
+	for {
+		r, err := p.NextBlock()
+		if err != nil {
+			return nil, err
+		}
+		buf.Reset()
+		_, err = buf.ReadFrom(r)
+		if err == blk.ErrBlockAborted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() == 0 {
+			return nil, ErrProtocol
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// 计算 r 的 SHA-256
+func hashOf(r io.ReaderAt, size int64) ([32]byte, error) {
+	var sum [32]byte
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return sum, err
+	}
+	if n != size {
+		return sum, io.ErrUnexpectedEOF
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// 发送文件
+type Sender struct {
+	// 每个数据 block 的文件数据大小，0 表示 DefaultBlockSize
+	BlockSize int
+
+	// 未确认数据的上限，0 表示 DefaultWindow
+	Window int64
+
+	// Transfer 没有进展时连续重新连接的次数，0 表示 DefaultRetries
+	Retries int
+
+	// 收到确认时调用
+	Progress func(acked, size int64)
+}
+
+// 在 p 上发送 r 的前 size 字节，接收端保存为 name，接收端校验通过后返回 nil。
+// 连接断开时返回读写错误，再次调用时从接收端确认过的位置继续。
+// 返回错误时 p 上可能还有 goroutine 在读取，调用者应该关闭连接。
+func (s *Sender) Send(p *blk.Blk, name string, r io.ReaderAt, size int64) error {
+	m, err := s.meta(name, r, size)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.send(p, m, r)
+	return err
+}
+
+// 与 Send 相同，dial 建立连接，连接断开后重新连接并续传，
+// 连续 Retries 次没有进展时返回最后的错误。每次传送结束后关闭 dial 返回的 Blk。
+func (s *Sender) Transfer(dial func() (*blk.Blk, error), name string, r io.ReaderAt, size int64) error {
+	m, err := s.meta(name, r, size)
+	if err != nil {
+		return err
+	}
+	retries := s.Retries
+	if retries <= 0 {
+		retries = DefaultRetries
+	}
+	var acked int64 = -1
+	delay := 100 * time.Millisecond
+	for fails := 0; ; {
+		var (
+			p     *blk.Blk
+			at    int64
+			retry = true
+		)
+		p, err = dial()
+		if err == nil {
+			at, retry, err = s.send(p, m, r)
+			p.SetCloseTimeout(0).Close()
+		}
+		if err == nil || !retry {
+			return err
+		}
+		if at > acked {
+			acked, fails, delay = at, 0, 100*time.Millisecond
+		} else if fails++; fails >= retries {
+			return err
+		}
+		time.Sleep(delay)
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+func (s *Sender) meta(name string, r io.ReaderAt, size int64) (*meta, error) {
+	if !validName(name) {
+		return nil, ErrName
+	}
+	hash, err := hashOf(r, size)
+	if err != nil {
+		return nil, err
+	}
+	window := s.Window
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &meta{size: size, hash: hash, window: window, name: name}, nil
+}
+
+// 发送一次，返回接收端确认的位置，retry 表示错误来自连接，可以重新连接后续传
+func (s *Sender) send(p *blk.Blk, m *meta, r io.ReaderAt) (acked int64, retry bool, err error) {
+	bsize := s.BlockSize
+	if bsize <= 0 {
+		bsize = DefaultBlockSize
+	}
+	if _, err = p.WriteBlock(m.encode()); err != nil {
+		return -1, true, err
+	}
+	var buf bytes.Buffer
+	b, err := readBlock(p, &buf)
+	if err != nil {
+		return -1, err != ErrProtocol, err
+	}
+	switch {
+	case b[0] == kindError:
+		return -1, false, remoteError(b[1:])
+	case b[0] != kindResume || len(b) != 9:
+		return -1, false, ErrProtocol
+	}
+	off := getOffset(b[1:])
+	if off < 0 || off > m.size {
+		return -1, false, ErrProtocol
+	}
+	acked = off
+
+	// 读取确认和最后的结果
+	acks := make(chan int64, 16)
+	result := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		var buf bytes.Buffer
+		for {
+			b, err := readBlock(p, &buf)
+			if err != nil {
+				result <- err
+				return
+			}
+			switch {
+			case b[0] == kindAck && len(b) == 9:
+				select {
+				case acks <- getOffset(b[1:]):
+				case <-quit:
+					return
+				}
+			case b[0] == kindDone:
+				result <- nil
+				return
+			case b[0] == kindError:
+				result <- remoteError(b[1:])
+				return
+			default:
+				result <- ErrProtocol
+				return
+			}
+		}
+	}()
+	done := func(err error) (int64, bool, error) {
+		if err == nil {
+			return acked, false, nil
+		}
+		_, remote := err.(*RemoteError)
+		return acked, !remote && err != ErrProtocol && err != ErrHash && err != ErrName, err
+	}
+	ack := func(n int64) {
+		acked = n
+		if s.Progress != nil {
+			s.Progress(n, m.size)
+		}
+	}
+
+	data := make([]byte, 9+bsize)
+	data[0] = kindData
+	for off < m.size {
+		for off-acked >= m.window {
+			select {
+			case n := <-acks:
+				ack(n)
+			case err = <-result:
+				return done(err)
+			}
+		}
+		n := int64(bsize)
+		if n > m.size-off {
+			n = m.size - off
+		}
+		putOffset(data[1:], off)
+		var k int
+		k, err = r.ReadAt(data[9:9+n], off)
+		if int64(k) == n {
+			err = nil
+		} else if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			p.WriteBlock(errorMessage(err))
+			return acked, false, err
+		}
+		if _, err = p.WriteBlock(data[:9+n]); err != nil {
+			return acked, true, err
+		}
+		off += n
+	}
+	if _, err = p.WriteBlock([]byte{kindEnd}); err != nil {
+		return acked, true, err
+	}
+	for {
+		select {
+		case n := <-acks:
+			ack(n)
+		case err = <-result:
+			for len(acks) != 0 {
+				ack(<-acks)
+			}
+			return done(err)
+		}
+	}
+}
+
+// 检查文件名，只允许不带路径的文件名
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) < 4096 &&
+		filepath.Base(name) == name && !os.IsPathSeparator(name[0])
+}
+
+// 接收文件并保存到 Dir
+type Receiver struct {
+	// 保存文件的目录
+	Dir string
+
+	// 确认的间隔，每次确认之前把数据同步到磁盘，0 表示 DefaultAckEvery
+	AckEvery int64
+
+	// 保存数据后调用
+	Progress func(name string, received, size int64)
+}
+
+// 接收一个文件，返回保存的路径。
+// 连接断开时返回读写错误，已经接收的数据和进度被保存，之后可以续传。
+// 校验失败时返回 ErrHash，并删除已经接收的数据。
+func (rc *Receiver) Receive(p *blk.Blk) (string, error) {
+	var buf bytes.Buffer
+	b, err := readBlock(p, &buf)
+	if err != nil {
+		return "", err
+	}
+	if b[0] != kindMeta || len(b) < metaSize {
+		return "", ErrProtocol
+	}
+	m := &meta{size: getOffset(b[1:]), window: getOffset(b[41:]), name: string(b[metaSize:])}
+	copy(m.hash[:], b[9:41])
+	if m.size < 0 || m.window <= 0 {
+		p.WriteBlock(errorMessage(ErrProtocol))
+		return "", ErrProtocol
+	}
+	if !validName(m.name) {
+		p.WriteBlock(errorMessage(ErrName))
+		return "", ErrName
+	}
+	path := filepath.Join(rc.Dir, m.name)
+	pt, err := openPart(path, m)
+	if err != nil {
+		p.WriteBlock(errorMessage(err))
+		return "", err
+	}
+	defer pt.close()
+	if _, err = p.WriteBlock(message(kindResume, pt.off)); err != nil {
+		return "", err
+	}
+
+	every := rc.AckEvery
+	if every <= 0 {
+		every = DefaultAckEvery
+	}
+	if every > m.window/2 {
+		every = m.window / 2
+	}
+	acked := pt.off
+	for {
+		b, err := readBlock(p, &buf)
+		if err != nil {
+			pt.save()
+			return "", err
+		}
+		switch b[0] {
+		case kindData:
+			if len(b) < 9 || getOffset(b[1:]) != pt.off || pt.off+int64(len(b)-9) > m.size {
+				p.WriteBlock(errorMessage(ErrProtocol))
+				return "", ErrProtocol
+			}
+			if err = pt.write(b[9:]); err != nil {
+				p.WriteBlock(errorMessage(err))
+				return "", err
+			}
+			if pt.off-acked < every {
+				continue
+			}
+		case kindEnd:
+			if pt.off != m.size {
+				p.WriteBlock(errorMessage(ErrProtocol))
+				return "", ErrProtocol
+			}
+		case kindError:
+			pt.save()
+			return "", remoteError(b[1:])
+		default:
+			p.WriteBlock(errorMessage(ErrProtocol))
+			return "", ErrProtocol
+		}
+
+		if err = pt.save(); err != nil {
+			p.WriteBlock(errorMessage(err))
+			return "", err
+		}
+		acked = pt.off
+		if rc.Progress != nil {
+			rc.Progress(m.name, acked, m.size)
+		}
+		if _, err = p.WriteBlock(message(kindAck, acked)); err != nil {
+			return "", err
+		}
+		if b[0] == kindEnd {
+			break
+		}
+	}
+
+	if err = pt.finish(path); err != nil {
+		p.WriteBlock(errorMessage(err))
+		return "", err
+	}
+	if _, err = p.WriteBlock([]byte{kindDone}); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// 循环接收文件直到连接断开或者出现协议错误，可以用作 blk.Server 的 Handler
+func (rc *Receiver) Serve(conn net.Conn, p *blk.Blk) {
+	for {
+		_, err := rc.Receive(p)
+		if _, remote := err.(*RemoteError); err != nil && err != ErrHash && err != ErrName && !remote {
+			return
+		}
+	}
+}
+
+// 接收中的文件
+type part struct {
+	f     *os.File
+	state string
+	m     *meta
+	off   int64 //已经写入的数据
+}
+
+// 打开 path 对应的 .part 文件，进度与 m 相符时从保存的位置继续，否则重新开始
+func openPart(path string, m *meta) (*part, error) {
+	pt := &part{state: path + ".part.state", m: m}
+	var err error
+	if pt.f, err = os.OpenFile(path+".part", os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	if s, err := os.ReadFile(pt.state); err == nil && len(s) == 48 &&
+		getOffset(s) == m.size && bytes.Equal(s[8:40], m.hash[:]) {
+		pt.off = getOffset(s[40:])
+		if fi, err := pt.f.Stat(); err != nil || fi.Size() < pt.off {
+			pt.off = 0
+		}
+	}
+	if err = pt.f.Truncate(pt.off); err == nil {
+		err = pt.save()
+	}
+	if err != nil {
+		pt.f.Close()
+		return nil, err
+	}
+	return pt, nil
+}
+
+func (pt *part) write(b []byte) error {
+	if _, err := pt.f.WriteAt(b, pt.off); err != nil {
+		return err
+	}
+	pt.off += int64(len(b))
+	return nil
+}
+
+// 把数据同步到磁盘并保存进度
+func (pt *part) save() error {
+	if err := pt.f.Sync(); err != nil {
+		return err
+	}
+	s := make([]byte, 48)
+	putOffset(s, pt.m.size)
+	copy(s[8:], pt.m.hash[:])
+	putOffset(s[40:], pt.off)
+	return os.WriteFile(pt.state, s, 0644)
+}
+
+// 校验数据，通过时改名为 path，否则删除数据和进度
+func (pt *part) finish(path string) error {
+	sum, err := hashOf(pt.f, pt.m.size)
+	if err != nil {
+		return err
+	}
+	if sum != pt.m.hash {
+		pt.close()
+		os.Remove(pt.f.Name())
+		os.Remove(pt.state)
+		return ErrHash
+	}
+	pt.close()
+	if err = os.Rename(pt.f.Name(), path); err != nil {
+		return err
+	}
+	os.Remove(pt.state)
+	return nil
+}
+
+func (pt *part) close() {
+	pt.f.Close()
+}
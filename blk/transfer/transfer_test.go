@@ -0,0 +1,147 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/achun/foo/blk"
+)
+
+// 写出 left 字节后断开的连接
+type flaky struct {
+	net.Conn
+	left *int64
+}
+
+func (c flaky) Write(b []byte) (int, error) {
+	if atomic.AddInt64(c.left, -int64(len(b))) < 0 {
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+// 启动 Receiver，返回接收目录和地址
+func serve(t *testing.T) (dir, addr string) {
+	dir = t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &Receiver{Dir: dir, AckEvery: 64 << 10}
+	srv := &blk.Server{Handler: rc.Serve}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return dir, l.Addr().String()
+}
+
+// 每个连接写出 700KB 后断开，Transfer 重连后从确认的位置继续
+func TestTransferResume(t *testing.T) {
+	dir, addr := serve(t)
+	data := make([]byte, 3<<20+123)
+	rand.Read(data)
+	var dials int32
+	dial := func() (*blk.Blk, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt32(&dials, 1)
+		left := int64(700 << 10)
+		return blk.NewBlk(c, flaky{c, &left}), nil
+	}
+	var last int64
+	s := &Sender{
+		Window:    256 << 10,
+		BlockSize: 16 << 10,
+		Progress: func(acked, size int64) {
+			if acked < atomic.LoadInt64(&last) || size != int64(len(data)) {
+				t.Error("progress", acked, size)
+			}
+			atomic.StoreInt64(&last, acked)
+		},
+	}
+	if err := s.Transfer(dial, "f.bin", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "f.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal(err, len(got))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f.bin.part.state")); !os.IsNotExist(err) {
+		t.Fatal("state left", err)
+	}
+	if n := atomic.LoadInt32(&dials); n < 4 {
+		t.Fatal("reconnects", n)
+	}
+	if last != int64(len(data)) {
+		t.Fatal("progress", last)
+	}
+}
+
+// 出错后连接仍然可以继续发送
+func TestSendErrors(t *testing.T) {
+	dir, addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := blk.NewBlk(c, c)
+	defer p.Close()
+	s := &Sender{}
+
+	// 哈希不一致：读取的数据与计算哈希时不同
+	m := &meta{size: 10, window: DefaultWindow, name: "bad"}
+	if _, retry, err := s.send(p, m, bytes.NewReader(make([]byte, 10))); err != ErrHash || retry {
+		t.Fatal(err, retry)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.part")); !os.IsNotExist(err) {
+		t.Fatal("part left", err)
+	}
+	if err := s.Send(p, "../x", bytes.NewReader(nil), 0); err != ErrName {
+		t.Fatal(err)
+	}
+	// 接收端拒绝的名字
+	m.name = "a/b"
+	if _, _, err := s.send(p, m, bytes.NewReader(make([]byte, 10))); err != ErrName {
+		t.Fatal(err)
+	}
+	// 文件比 size 短
+	if err := s.Send(p, "short", bytes.NewReader([]byte("hi")), 5); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	if err := s.Send(p, "small", bytes.NewReader([]byte("hello")), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "small")); string(got) != "hello" {
+		t.Fatalf("%q", got)
+	}
+	if err := s.Send(p, "empty", bytes.NewReader(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "empty")); err != nil || fi.Size() != 0 {
+		t.Fatal(err)
+	}
+}
+
+// 发送时读到的数据比 size 短
+func TestSendShortRead(t *testing.T) {
+	_, addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 还有 goroutine 在读取 p，只能关闭连接
+	defer c.Close()
+	p := blk.NewBlk(c, c)
+	m := &meta{size: 10, window: DefaultWindow, name: "short"}
+	if _, retry, err := (&Sender{}).send(p, m, bytes.NewReader(make([]byte, 5))); err != io.ErrUnexpectedEOF || retry {
+		t.Fatal(err, retry)
+	}
+}